@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/transform"
+)
+
+// encodingAlias keeps the encoding names accepted by earlier versions.
+var encodingAlias = map[string]string{
+	"gb10830": "gb18030",
+}
+
+// decodeBody converts body to utf-8. The charset is read from the BOM, the
+// Content-Type header and <meta charset> in this order, encodingName overrides
+// the detected charset when it is not empty.
+func decodeBody(body []byte, contentType, encodingName string) ([]byte, error) {
+	var e encoding.Encoding
+	if encodingName != "" {
+		name := strings.ToLower(strings.TrimSpace(encodingName))
+		if alias, ok := encodingAlias[name]; ok {
+			name = alias
+		}
+		var err error
+		e, err = htmlindex.Get(name)
+		if err != nil {
+			return nil, fmt.Errorf("unknown encoding %s:%v", encodingName, err)
+		}
+	} else {
+		var name string
+		var certain bool
+		e, name, certain = charset.DetermineEncoding(body, contentType)
+		// a page without any declaration is kept as utf-8 instead of the
+		// windows-1252 guess of the html spec
+		if !certain && name == "windows-1252" && metaCharset(body) == "" {
+			e = encoding.Nop
+		}
+	}
+	decoded, _, err := transform.Bytes(e.NewDecoder(), body)
+	if err != nil {
+		return nil, fmt.Errorf("decode body fail:%v", err)
+	}
+	return bytes.TrimPrefix(decoded, []byte("\ufeff")), nil
+}
+
+// metaCharset returns the charset declared by a <meta> in the first 1024 bytes
+// of body, where charset.DetermineEncoding looks for it.
+func metaCharset(body []byte) string {
+	if len(body) > 1024 {
+		body = body[:1024]
+	}
+	z := html.NewTokenizer(bytes.NewReader(body))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return ""
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			if string(name) != "meta" {
+				continue
+			}
+			attrs := map[string]string{}
+			for hasAttr {
+				var key, val []byte
+				key, val, hasAttr = z.TagAttr()
+				attrs[string(key)] = string(val)
+			}
+			if attrs["charset"] != "" {
+				return attrs["charset"]
+			}
+			if strings.EqualFold(attrs["http-equiv"], "content-type") {
+				if _, params, err := mime.ParseMediaType(attrs["content"]); err == nil && params["charset"] != "" {
+					return params["charset"]
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/andybalholm/cascadia"
+	"github.com/antchfx/xpath"
+)
+
+// confError names the section of the channel config where err is found.
+func confError(section string, err error) error {
+	return fmt.Errorf("[%s] %v", section, err)
+}
+
+// compile checks the selectors, regexes, templates and plugins of the rule and
+// keeps their compiled forms, so a bad config fails when it is loaded instead
+// of in the middle of a crawl.
+func (r *Rule) compile() error {
+	if r.compiled {
+		return nil
+	}
+	r.tocTemplates = []*template.Template{}
+	for i, tocUrl := range append([]string{r.TocUrl}, r.TocUrlList...) {
+		var tmpl *template.Template
+		if strings.Contains(tocUrl, "{{") {
+			var err error
+			if tmpl, err = generateTemplate(fmt.Sprintf("tocUrl%d", i), tocUrl); err != nil {
+				if i == 0 {
+					return confError("Rule", fmt.Errorf("TocUrl:%v", err))
+				}
+				return confError("Rule", fmt.Errorf("TocUrlList[%d]:%v", i-1, err))
+			}
+		}
+		r.tocTemplates = append(r.tocTemplates, tmpl)
+	}
+	if err := r.compileBodyTemplate(); err != nil {
+		return confError("Rule", err)
+	}
+	r.itemMatcher, r.itemXPath = nil, nil
+	if r.ItemSelector != "" {
+		matcher, err := cascadia.Compile(r.ItemSelector)
+		if err != nil {
+			return confError("Rule", fmt.Errorf("ItemSelector:%v", err))
+		}
+		r.itemMatcher = matcher
+	}
+	if r.ItemXPath != "" {
+		expr, err := xpath.Compile(r.ItemXPath)
+		if err != nil {
+			return confError("Rule", fmt.Errorf("ItemXPath:%v", err))
+		}
+		r.itemXPath = expr
+	}
+	if r.hasNextPage() {
+		if err := r.NextPageSelector.compile(); err != nil {
+			return confError("Rule.NextPageSelector", err)
+		}
+	}
+	if err := compileSelectors("Rule.KeyParseConf", r.KeyParseConf); err != nil {
+		return err
+	}
+	if err := compileSelectors("Rule.ExtraKeyParseConf", r.ExtraKeyParseConf); err != nil {
+		return err
+	}
+	if err := compileJsonSelectors("Rule.JsonKeyParseConf", r.JsonKeyParseConf); err != nil {
+		return err
+	}
+	if r.ExtraJsonSource != nil {
+		if err := compileJsonSelectors("Rule.ExtraJsonSource.KeyParseConf", r.ExtraJsonSource.KeyParseConf); err != nil {
+			return err
+		}
+	}
+	if err := r.buildStages(); err != nil {
+		return err
+	}
+	r.filters = nil
+	if err := r.compileFilters(); err != nil {
+		return err
+	}
+	filter, err := r.Sitemap.filter()
+	if err != nil {
+		return confError("Rule.Sitemap", err)
+	}
+	r.sitemapFilter = filter
+	r.compiled = true
+	return nil
+}
+
+// compile keeps the compiled Selector, XPath, Regex and Transforms of e.
+func (e *ElementSelector) compile() error {
+	e.matcher, e.xpathExpr, e.regex = nil, nil, nil
+	if e.Selector != "" {
+		matcher, err := cascadia.Compile(e.Selector)
+		if err != nil {
+			return fmt.Errorf("Selector:%v", err)
+		}
+		e.matcher = matcher
+	}
+	if e.XPath != "" {
+		expr, err := xpath.Compile(e.XPath)
+		if err != nil {
+			return fmt.Errorf("XPath:%v", err)
+		}
+		e.xpathExpr = expr
+	}
+	if e.Regex != "" {
+		regex, err := regexp.Compile(e.Regex)
+		if err != nil {
+			return fmt.Errorf("Regex:%v", err)
+		}
+		e.regex = regex
+	}
+	for i := range e.Transforms {
+		if err := e.Transforms[i].compile(); err != nil {
+			return fmt.Errorf("Transforms[%d]:%v", i, err)
+		}
+	}
+	return nil
+}
+
+func (e *JsonElementSelector) compile() error {
+	e.regex = nil
+	if e.Regex != "" {
+		regex, err := regexp.Compile(e.Regex)
+		if err != nil {
+			return fmt.Errorf("Regex:%v", err)
+		}
+		e.regex = regex
+	}
+	return nil
+}
+
+// compileSelectors compiles the selectors of conf in place, section is the
+// name of conf in the channel config.
+func compileSelectors(section string, conf map[string]ElementSelector) error {
+	for k, selector := range conf {
+		if err := selector.compile(); err != nil {
+			return confError(section+"."+k, err)
+		}
+		conf[k] = selector
+	}
+	return nil
+}
+
+func compileJsonSelectors(section string, conf map[string]JsonElementSelector) error {
+	for k, selector := range conf {
+		if err := selector.compile(); err != nil {
+			return confError(section+"."+k, err)
+		}
+		conf[k] = selector
+	}
+	return nil
+}
+
+// checkPlugin reports whether the plugin file of key exists.
+func checkPlugin(section, key, plugin string) error {
+	if plugin == "" {
+		return nil
+	}
+	if _, err := os.Stat(plugin); err != nil {
+		return confError(section, fmt.Errorf("%s:%v", key, err))
+	}
+	return nil
+}
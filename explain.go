@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+const explainMaxSample = 80
+
+type (
+	// explainer records how the selectors of a rule match the pages, it is
+	// set by `test`.
+	explainer struct {
+		lock sync.Mutex
+		tocs []tocExplain
+		keys map[string]*keyExplain
+	}
+	tocExplain struct {
+		url   string
+		nodes int
+		err   error
+	}
+	keyExplain struct {
+		section  string
+		key      string
+		required bool
+		nodes    int
+		items    int
+		matched  int
+		// raw is the text of the first node matched, regex the capture of
+		// Regex in raw.
+		raw   string
+		regex string
+		empty []string
+	}
+)
+
+func newExplainer() *explainer {
+	return &explainer{keys: map[string]*keyExplain{}}
+}
+
+func (x *explainer) toc(tocUrl string, nodes int, err error) {
+	if x == nil {
+		return
+	}
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	x.tocs = append(x.tocs, tocExplain{url: tocUrl, nodes: nodes, err: err})
+}
+
+// seed adds the keys of conf before the pages are parsed, a Required key is
+// missing until an item renders it.
+func (x *explainer) seed(section string, conf map[string]ElementSelector) {
+	if x == nil {
+		return
+	}
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	for k, selector := range conf {
+		name := section + "." + k
+		if _, ok := x.keys[name]; !ok {
+			x.keys[name] = &keyExplain{section: section, key: k, required: selector.Required}
+		}
+	}
+}
+
+// fail records the keys of conf empty for the entry item whose page failed.
+func (x *explainer) fail(section string, conf map[string]ElementSelector, itemKey string) {
+	if x == nil {
+		return
+	}
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	for k, selector := range conf {
+		name := section + "." + k
+		stat, ok := x.keys[name]
+		if !ok {
+			stat = &keyExplain{section: section, key: k, required: selector.Required}
+			x.keys[name] = stat
+		}
+		stat.items++
+		stat.empty = append(stat.empty, itemKey)
+	}
+}
+
+// record records the selectors of conf applied to s for the entry item, the
+// selectors are run again to get the raw texts before the regexes.
+func (x *explainer) record(section string, conf map[string]ElementSelector, s *goquery.Selection, item map[string]interface{}, itemKey string) {
+	if x == nil {
+		return
+	}
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	for k, selector := range conf {
+		name := section + "." + k
+		stat, ok := x.keys[name]
+		if !ok {
+			stat = &keyExplain{section: section, key: k, required: selector.Required}
+			x.keys[name] = stat
+		}
+		stat.items++
+		if selection, err := selector.selectElements(s); err == nil {
+			stat.nodes += selection.Length()
+			if selection.Length() > 0 {
+				stat.matched++
+			}
+			if stat.raw == "" && selection.Length() > 0 {
+				raw, _ := selector.elementText(selection.First())
+				stat.raw = strings.TrimSpace(raw)
+				if selector.Regex != "" {
+					stat.regex = explainValue(selector.regexCapture(raw))
+				}
+			}
+		}
+		if isEmptyValue(item[k]) {
+			stat.empty = append(stat.empty, itemKey)
+		}
+	}
+}
+
+func explainValue(value interface{}) string {
+	text := strings.Join(filterValues(value), ", ")
+	text = strings.Join(strings.Fields(text), " ")
+	if len([]rune(text)) > explainMaxSample {
+		text = string([]rune(text)[:explainMaxSample]) + "..."
+	}
+	return text
+}
+
+// failures returns the toc urls failed or matching no item and the required
+// keys not rendered by every item.
+func (x *explainer) failures() []string {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	failures := []string{}
+	for _, toc := range x.tocs {
+		if toc.err != nil {
+			failures = append(failures, fmt.Sprintf("toc %s: %v", toc.url, toc.err))
+		} else if toc.nodes == 0 {
+			failures = append(failures, fmt.Sprintf("toc %s: no item matched", toc.url))
+		}
+	}
+	for _, name := range x.sortedKeys() {
+		stat := x.keys[name]
+		if stat.required && (stat.items == 0 || len(stat.empty) > 0) {
+			failures = append(failures, fmt.Sprintf("[%s] %s is empty", stat.section, stat.key))
+		}
+	}
+	return failures
+}
+
+func (x *explainer) sortedKeys() []string {
+	names := make([]string, 0, len(x.keys))
+	for name := range x.keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// report logs the records.
+func (x *explainer) report() {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	for _, toc := range x.tocs {
+		if toc.err != nil {
+			LOGGER.Infof("toc %s: %v", toc.url, toc.err)
+			continue
+		}
+		LOGGER.Infof("toc %s: ItemSelector matched %d nodes", toc.url, toc.nodes)
+	}
+	for _, name := range x.sortedKeys() {
+		stat := x.keys[name]
+		required := ""
+		if stat.required {
+			required = " (required)"
+		}
+		LOGGER.Infof("[%s] %s%s: matched %d nodes in %d/%d items", stat.section, stat.key, required, stat.nodes, stat.matched, stat.items)
+		if stat.raw != "" {
+			LOGGER.Infof("    raw: %s", explainValue(stat.raw))
+		}
+		if stat.regex != "" {
+			LOGGER.Infof("    regex: %s", stat.regex)
+		}
+		if len(stat.empty) > 0 {
+			LOGGER.Infof("    empty in %d items: %s", len(stat.empty), strings.Join(stat.empty, ", "))
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/imroc/req/v3"
+)
+
+type (
+	// ExtraStage is a hop of the extra page chain. Source and Body are rendered
+	// with the keys of the toc entry and of the previous stages, the keys found
+	// by the stage are merged into the item.
+	ExtraStage struct {
+		Source           string
+		Method           string
+		Body             string
+		ContentType      string
+		Headers          map[string]string
+		KeyParseConf     map[string]ElementSelector
+		JsonKeyParseConf map[string]JsonElementSelector
+		Plugin           string
+		AutoContent      bool
+	}
+	extraStage struct {
+		ExtraStage
+		isJson bool
+		// section of the stage in the channel config
+		section string
+		client  *req.Client
+		source  *template.Template
+		body    *template.Template
+	}
+)
+
+// buildStages compiles the extra stages of the rule, the ExtraSource settings
+// are the first stage when ExtraSource is set.
+func (r *Rule) buildStages() error {
+	stages := []*extraStage{}
+	if source := r.extraSource(); source != "" {
+		stage := &extraStage{
+			ExtraStage: ExtraStage{
+				Source:       source,
+				Method:       r.ExtraMethod,
+				Body:         r.ExtraBody,
+				ContentType:  r.ExtraContentType,
+				Headers:      r.ExtraSourceHeaders,
+				KeyParseConf: r.ExtraKeyParseConf,
+				Plugin:       r.ExtraKeyParsePlugin,
+				AutoContent:  r.ExtraAutoContent,
+			},
+		}
+		if r.ExtraJsonSource != nil {
+			stage.isJson = true
+			stage.JsonKeyParseConf = r.ExtraJsonSource.KeyParseConf
+		}
+		stages = append(stages, stage)
+	}
+	for _, conf := range r.ExtraStages {
+		stages = append(stages, &extraStage{
+			ExtraStage: conf,
+			isJson:     len(conf.JsonKeyParseConf) > 0,
+		})
+	}
+	for i, stage := range stages {
+		section, sourceKey, bodyKey := fmt.Sprintf("Rule.ExtraStages[%d]", i), "Source", "Body"
+		if r.extraSource() != "" {
+			section = fmt.Sprintf("Rule.ExtraStages[%d]", i-1)
+			if i == 0 {
+				section, sourceKey, bodyKey = "Rule", "ExtraSource", "ExtraBody"
+			}
+		}
+		if stage.Source == "" {
+			return confError(section, fmt.Errorf("%s is empty", sourceKey))
+		}
+		var err error
+		if stage.source, err = generateTemplate(fmt.Sprintf("extraSource%d", i), stage.Source); err != nil {
+			return confError(section, fmt.Errorf("%s:%v", sourceKey, err))
+		}
+		if stage.Body != "" {
+			if stage.body, err = generateTemplate(fmt.Sprintf("extraBody%d", i), stage.Body); err != nil {
+				return confError(section, fmt.Errorf("%s:%v", bodyKey, err))
+			}
+		}
+		if section == "Rule" {
+			err = checkPlugin(section, "ExtraKeyParsePlugin", stage.Plugin)
+		} else {
+			err = checkPlugin(section, "Plugin", stage.Plugin)
+		}
+		if err != nil {
+			return err
+		}
+		stage.section = section + ".KeyParseConf"
+		if section == "Rule" {
+			stage.section = "Rule.ExtraKeyParseConf"
+		} else {
+			if err = compileSelectors(section+".KeyParseConf", stage.KeyParseConf); err != nil {
+				return err
+			}
+			if err = compileJsonSelectors(section+".JsonKeyParseConf", stage.JsonKeyParseConf); err != nil {
+				return err
+			}
+		}
+	}
+	// the stages are published with their clients
+	r.initStages(stages)
+	r.stages = stages
+	return nil
+}
+
+// initStages creates the clients of the extra stages.
+func (r *Rule) initStages(stages []*extraStage) {
+	for i, stage := range stages {
+		if stage.client != nil {
+			continue
+		}
+		if i == 0 && r.extraSource() != "" {
+			stage.client = r.getClient(true)
+		} else {
+			stage.client = r.newClient(stage.Headers)
+		}
+	}
+}
+
+// runStage requests the page of stage and merges the keys found into item. A
+// stage whose url renders empty is skipped.
+func (r *Rule) runStage(stage *extraStage, item map[string]interface{}, pageIndex int) error {
+	var tpl bytes.Buffer
+	if err := stage.source.Execute(&tpl, item); err != nil {
+		return fmt.Errorf("execute extra source template fail:%v", err)
+	}
+	stageUrl := strings.TrimSpace(tpl.String())
+	if stageUrl == "" {
+		return nil
+	}
+	if stage.Plugin != "" {
+		ctx := r.newContext()
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		ctx, cancel := context.WithTimeout(ctx, r.timeout(true))
+		defer cancel()
+		extraItem, err := runGolangPlugin(stage.Plugin, stageUrl, ctx, r.pluginFetch(stage.client), &pluginTransport{rule: r, client: stage.client})
+		if err != nil {
+			return err
+		}
+		for k, v := range extraItem {
+			item[k] = v
+		}
+		return nil
+	}
+	body, err := renderBody(stage.body, item, pageIndex)
+	if err != nil {
+		return err
+	}
+	res, err := r.send(&httpRequest{
+		client:      stage.client,
+		method:      requestMethod(stage.Method),
+		url:         stageUrl,
+		body:        body,
+		contentType: stage.ContentType,
+		timeout:     r.timeout(true),
+	})
+	if err != nil {
+		return err
+	}
+	if stage.isJson {
+		content, err := r.decodeBody(res)
+		if err != nil {
+			return err
+		}
+		data, err := decodeJson(content)
+		if err != nil {
+			return fmt.Errorf("parse extra page %s to json fail:%v", stageUrl, err)
+		}
+		for k, selector := range stage.JsonKeyParseConf {
+			item[k] = selector.getKey(data)
+		}
+		return nil
+	}
+	doc, err := r.newDocument(res)
+	if err != nil {
+		return fmt.Errorf("parse extra page %s fail:%v", stageUrl, err)
+	}
+	parseKeys(item, stage.KeyParseConf, func(e *ElementSelector) (interface{}, map[string]interface{}) {
+		return e.getKeys(doc.Selection, docUrl(doc), true, true)
+	})
+	r.explain.record(stage.section, stage.KeyParseConf, doc.Selection, item, fmt.Sprint(item[r.Key]))
+	if stage.AutoContent {
+		for k, v := range autoContent(doc, stageUrl) {
+			if _, ok := stage.KeyParseConf[k]; !ok {
+				item[k] = v
+			}
+		}
+	}
+	return nil
+}
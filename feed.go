@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html/charset"
+)
+
+type (
+	rssFeed struct {
+		Items []rssItem `xml:"channel>item"`
+		// items of rss 1.0 are children of rdf:RDF
+		RdfItems []rssItem `xml:"item"`
+	}
+	rssItem struct {
+		Title       string   `xml:"title"`
+		Link        string   `xml:"link"`
+		Guid        string   `xml:"guid"`
+		PubDate     string   `xml:"pubDate"`
+		Date        string   `xml:"http://purl.org/dc/elements/1.1/ date"`
+		Description string   `xml:"description"`
+		Content     string   `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+		Author      string   `xml:"author"`
+		Creator     string   `xml:"http://purl.org/dc/elements/1.1/ creator"`
+		Category    []string `xml:"category"`
+		Enclosure   struct {
+			Url string `xml:"url,attr"`
+		} `xml:"enclosure"`
+	}
+	atomFeed struct {
+		Entries []atomEntry `xml:"entry"`
+	}
+	atomEntry struct {
+		Title     string     `xml:"title"`
+		Id        string     `xml:"id"`
+		Links     []atomLink `xml:"link"`
+		Published string     `xml:"published"`
+		Updated   string     `xml:"updated"`
+		Summary   string     `xml:"summary"`
+		Content   string     `xml:"content"`
+		Author    []string   `xml:"author>name"`
+		Category  []struct {
+			Term string `xml:"term,attr"`
+		} `xml:"category"`
+	}
+	atomLink struct {
+		Href string `xml:"href,attr"`
+		Rel  string `xml:"rel,attr"`
+	}
+	jsonFeed struct {
+		Items []struct {
+			Id            interface{} `json:"id"`
+			Url           string      `json:"url"`
+			Title         string      `json:"title"`
+			ContentHtml   string      `json:"content_html"`
+			ContentText   string      `json:"content_text"`
+			Summary       string      `json:"summary"`
+			Image         string      `json:"image"`
+			DatePublished string      `json:"date_published"`
+			DateModified  string      `json:"date_modified"`
+			Tags          []string    `json:"tags"`
+			Author        struct {
+				Name string `json:"name"`
+			} `json:"author"`
+			Authors []struct {
+				Name string `json:"name"`
+			} `json:"authors"`
+			Attachments []struct {
+				Url string `json:"url"`
+			} `json:"attachments"`
+		} `json:"items"`
+	}
+)
+
+var feedDateLayouts = []string{
+	time.RFC1123Z,
+	time.RFC1123,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"2 Jan 2006 15:04:05 -0700",
+	time.RFC822Z,
+	time.RFC822,
+	time.RFC3339Nano,
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// normalizeFeedDate converts the date of a feed to RFC3339, the value is kept
+// when no layout matches.
+func normalizeFeedDate(value string) string {
+	value = strings.TrimSpace(value)
+	for _, layout := range feedDateLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.Format(time.RFC3339)
+		}
+	}
+	return value
+}
+
+// newXmlDecoder reads the charset from the xml declaration, encodingName
+// overrides it when it is not empty.
+func newXmlDecoder(body []byte, encodingName string) (*xml.Decoder, error) {
+	if encodingName == "" {
+		decoder := xml.NewDecoder(bytes.NewReader(body))
+		decoder.CharsetReader = charset.NewReaderLabel
+		return decoder, nil
+	}
+	decoded, err := decodeBody(body, "", encodingName)
+	if err != nil {
+		return nil, err
+	}
+	decoder := xml.NewDecoder(bytes.NewReader(decoded))
+	decoder.CharsetReader = func(label string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	return decoder, nil
+}
+
+func firstNotEmpty(values ...string) string {
+	for _, v := range values {
+		if strings.TrimSpace(v) != "" {
+			return strings.TrimSpace(v)
+		}
+	}
+	return ""
+}
+
+// parseFeed reads the entries of a rss, atom or json feed, every entry has the
+// keys title, link, guid, pubDate, description, content, author, category and
+// enclosure.
+func parseFeed(body []byte, encodingName string) ([]map[string]interface{}, error) {
+	if trimmed := bytes.TrimSpace(bytes.TrimPrefix(body, []byte("\xef\xbb\xbf"))); len(trimmed) > 0 && trimmed[0] == '{' {
+		return parseJsonFeed(trimmed)
+	}
+	decoder, err := newXmlDecoder(body, encodingName)
+	if err != nil {
+		return nil, err
+	}
+	var root xml.StartElement
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, fmt.Errorf("parse feed fail:%v", err)
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			root = start
+			break
+		}
+	}
+	switch strings.ToLower(root.Name.Local) {
+	case "feed":
+		feed := atomFeed{}
+		if err = decoder.DecodeElement(&feed, &root); err != nil {
+			return nil, fmt.Errorf("parse atom feed fail:%v", err)
+		}
+		return feed.entries(), nil
+	case "rss", "rdf":
+		feed := rssFeed{}
+		if err = decoder.DecodeElement(&feed, &root); err != nil {
+			return nil, fmt.Errorf("parse rss feed fail:%v", err)
+		}
+		return feed.entries(), nil
+	default:
+		return nil, fmt.Errorf("unknown feed format: %s", root.Name.Local)
+	}
+}
+
+func (f *rssFeed) entries() []map[string]interface{} {
+	entries := []map[string]interface{}{}
+	for _, item := range append(f.Items, f.RdfItems...) {
+		entries = append(entries, map[string]interface{}{
+			"title":       strings.TrimSpace(item.Title),
+			"link":        strings.TrimSpace(item.Link),
+			"guid":        firstNotEmpty(item.Guid, item.Link),
+			"pubDate":     normalizeFeedDate(firstNotEmpty(item.PubDate, item.Date)),
+			"description": item.Description,
+			"content":     firstNotEmpty(item.Content, item.Description),
+			"author":      firstNotEmpty(item.Creator, item.Author),
+			"category":    strings.Join(item.Category, ","),
+			"enclosure":   item.Enclosure.Url,
+		})
+	}
+	return entries
+}
+
+func (f *atomFeed) entries() []map[string]interface{} {
+	entries := []map[string]interface{}{}
+	for _, entry := range f.Entries {
+		link, enclosure := "", ""
+		for _, l := range entry.Links {
+			switch l.Rel {
+			case "alternate", "":
+				if link == "" {
+					link = l.Href
+				}
+			case "enclosure":
+				if enclosure == "" {
+					enclosure = l.Href
+				}
+			}
+		}
+		categories := []string{}
+		for _, c := range entry.Category {
+			categories = append(categories, c.Term)
+		}
+		entries = append(entries, map[string]interface{}{
+			"title":       strings.TrimSpace(entry.Title),
+			"link":        link,
+			"guid":        firstNotEmpty(entry.Id, link),
+			"pubDate":     normalizeFeedDate(firstNotEmpty(entry.Published, entry.Updated)),
+			"description": firstNotEmpty(entry.Summary, entry.Content),
+			"content":     firstNotEmpty(entry.Content, entry.Summary),
+			"author":      strings.Join(entry.Author, ","),
+			"category":    strings.Join(categories, ","),
+			"enclosure":   enclosure,
+		})
+	}
+	return entries
+}
+
+func parseJsonFeed(body []byte) ([]map[string]interface{}, error) {
+	feed := jsonFeed{}
+	if err := json.Unmarshal(body, &feed); err != nil {
+		return nil, fmt.Errorf("parse json feed fail:%v", err)
+	}
+	entries := []map[string]interface{}{}
+	for _, item := range feed.Items {
+		authors := []string{}
+		if item.Author.Name != "" {
+			authors = append(authors, item.Author.Name)
+		}
+		for _, a := range item.Authors {
+			authors = append(authors, a.Name)
+		}
+		enclosure := item.Image
+		if len(item.Attachments) > 0 {
+			enclosure = item.Attachments[0].Url
+		}
+		entries = append(entries, map[string]interface{}{
+			"title":       item.Title,
+			"link":        item.Url,
+			"guid":        firstNotEmpty(jsonValueToString(item.Id), item.Url),
+			"pubDate":     normalizeFeedDate(firstNotEmpty(item.DatePublished, item.DateModified)),
+			"description": firstNotEmpty(item.Summary, item.ContentHtml, item.ContentText),
+			"content":     firstNotEmpty(item.ContentHtml, item.ContentText, item.Summary),
+			"author":      strings.Join(authors, ","),
+			"category":    strings.Join(item.Tags, ","),
+			"enclosure":   enclosure,
+		})
+	}
+	return entries, nil
+}
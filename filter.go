@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	filterInclude = "include"
+	filterExclude = "exclude"
+)
+
+type (
+	// FilterConf is a condition on the key Key of the items. An include filter
+	// drops the items not matching it, an exclude filter drops the items
+	// matching it. The conditions set are all required to match.
+	//
+	// Op compares the key with Value: a number Value compares the first number
+	// of the key, otherwise Value is a date, or a duration relative to now
+	// such as "-7d" or "-12h", compared with the key parsed as a date.
+	FilterConf struct {
+		Action   string
+		Key      string
+		Regex    string
+		Contains string
+		Op       string
+		Value    string
+	}
+	itemFilter struct {
+		FilterConf
+		regex  *regexp.Regexp
+		number *float64
+		// date is set when Value is a date, relative durations are computed
+		// on each match.
+		date     time.Time
+		relative time.Duration
+	}
+	// FilterDrop records an item dropped by a filter.
+	FilterDrop struct {
+		Filter string
+		Item   string
+		// toc is set when the item is dropped with the keys of the toc page,
+		// only these drops are stored.
+		toc bool
+	}
+	errFiltered struct {
+		filter *itemFilter
+	}
+)
+
+var (
+	filter_number_pattern   = regexp.MustCompile(`-?\d+(\.\d+)?`)
+	filter_relative_pattern = regexp.MustCompile(`^([+-]?\d+)([smhd])$`)
+	filter_cn_date_pattern  = regexp.MustCompile(`^\d+[秒分小时天月]`)
+)
+
+func (e *errFiltered) Error() string {
+	return "dropped by filter " + e.filter.String()
+}
+
+func (f *itemFilter) String() string {
+	desc := []string{f.Action, f.Key}
+	if f.Regex != "" {
+		desc = append(desc, "regex", strconv.Quote(f.Regex))
+	}
+	if f.Contains != "" {
+		desc = append(desc, "contains", strconv.Quote(f.Contains))
+	}
+	if f.Op != "" {
+		desc = append(desc, f.Op, f.Value)
+	}
+	return strings.Join(desc, " ")
+}
+
+func (c FilterConf) compile() (*itemFilter, error) {
+	f := &itemFilter{FilterConf: c}
+	f.Action = strings.ToLower(f.Action)
+	if f.Action == "" {
+		f.Action = filterInclude
+	}
+	if f.Action != filterInclude && f.Action != filterExclude {
+		return nil, fmt.Errorf("unknown action: %s", c.Action)
+	}
+	if f.Key == "" {
+		return nil, fmt.Errorf("key is empty")
+	}
+	if f.Regex == "" && f.Contains == "" && f.Op == "" {
+		return nil, fmt.Errorf("no condition of key %s", f.Key)
+	}
+	if f.Regex != "" {
+		regex, err := regexp.Compile(f.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("compile regex fail:%v", err)
+		}
+		f.regex = regex
+	}
+	if f.Op == "" {
+		return f, nil
+	}
+	switch f.Op {
+	case "<", "<=", ">", ">=", "==", "!=":
+	default:
+		return nil, fmt.Errorf("unknown op: %s", f.Op)
+	}
+	value := strings.TrimSpace(f.Value)
+	if number, err := strconv.ParseFloat(value, 64); err == nil {
+		f.number = &number
+		return f, nil
+	}
+	if match := filter_relative_pattern.FindStringSubmatch(value); match != nil {
+		n, _ := strconv.Atoi(match[1])
+		unit := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour, "d": time.Hour * 24}[match[2]]
+		f.relative = time.Duration(n) * unit
+		return f, nil
+	}
+	date, ok := parseFilterDate(value)
+	if !ok {
+		return nil, fmt.Errorf("value %s is not a number, a date or a duration", f.Value)
+	}
+	f.date = date
+	return f, nil
+}
+
+func parseFilterDate(value string) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	if t, err := time.Parse(time.RFC3339, normalizeFeedDate(value)); err == nil {
+		return t, true
+	}
+	if filter_cn_date_pattern.MatchString(value) {
+		if t, err := currentBeforeCn(value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// match reports whether a value of the key matches every condition, a list
+// matches when one of its elements matches.
+func (f *itemFilter) match(value interface{}) bool {
+	for _, v := range filterValues(value) {
+		if f.matchValue(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *itemFilter) matchValue(value string) bool {
+	if f.regex != nil && !f.regex.MatchString(value) {
+		return false
+	}
+	if f.Contains != "" && !strings.Contains(value, f.Contains) {
+		return false
+	}
+	if f.Op == "" {
+		return true
+	}
+	if f.number != nil {
+		raw := filter_number_pattern.FindString(value)
+		if raw == "" {
+			return false
+		}
+		number, err := strconv.ParseFloat(raw, 64)
+		return err == nil && compareFilter(f.Op, number-*f.number)
+	}
+	date, ok := parseFilterDate(value)
+	if !ok {
+		return false
+	}
+	expect := f.date
+	if expect.IsZero() {
+		expect = time.Now().Add(f.relative)
+	}
+	return compareFilter(f.Op, float64(date.Sub(expect)))
+}
+
+func compareFilter(op string, diff float64) bool {
+	switch op {
+	case "<":
+		return diff < 0
+	case "<=":
+		return diff <= 0
+	case ">":
+		return diff > 0
+	case ">=":
+		return diff >= 0
+	case "==":
+		return diff == 0
+	default:
+		return diff != 0
+	}
+}
+
+func filterValues(value interface{}) []string {
+	switch v := value.(type) {
+	case nil:
+		return []string{""}
+	case []string:
+		if len(v) == 0 {
+			return []string{""}
+		}
+		return v
+	case []interface{}:
+		if len(v) == 0 {
+			return []string{""}
+		}
+		values := []string{}
+		for _, e := range v {
+			values = append(values, filterValues(e)...)
+		}
+		return values
+	case time.Time:
+		return []string{v.Format(time.RFC3339)}
+	default:
+		return []string{fmt.Sprint(v)}
+	}
+}
+
+// compileFilters compiles Rule.Filters once.
+func (r *Rule) compileFilters() error {
+	if r.filters != nil {
+		return nil
+	}
+	filters := []*itemFilter{}
+	for i, conf := range r.Filters {
+		f, err := conf.compile()
+		if err != nil {
+			return confError(fmt.Sprintf("Rule.Filters[%d]", i), err)
+		}
+		filters = append(filters, f)
+	}
+	r.filters = filters
+	return nil
+}
+
+// filterItem returns the first filter dropping item. With partial set, the
+// filters on the keys missing in item are skipped, so the toc entries are
+// filtered before the extra pages are requested.
+func (r *Rule) filterItem(item map[string]interface{}, partial bool) *itemFilter {
+	for _, f := range r.filters {
+		value, ok := item[f.Key]
+		if !ok && partial {
+			continue
+		}
+		if f.match(value) != (f.Action == filterInclude) {
+			return f
+		}
+	}
+	return nil
+}
+
+// isDropped reports whether the item key was dropped by a filter of a previous
+// run which is still configured, so its extra pages are not requested again.
+func (r *Rule) isDropped(key string) bool {
+	if r.repository == nil || len(r.filters) == 0 {
+		return false
+	}
+	filter, err := r.repository.FindDrop(r.channel, key)
+	if err != nil {
+		LOGGER.Error(err)
+		return false
+	}
+	for _, f := range r.filters {
+		if f.String() == filter {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterDrops returns the items dropped by the filters in the last
+// GenerateItem.
+func (r *Rule) FilterDrops() []FilterDrop {
+	return r.filterDrops
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+
+	"github.com/imroc/req/v3"
+)
+
+type (
+	// fixtureStore records every response of the rule clients into dir, or
+	// serves the recorded responses back in replay mode. A fixture is the
+	// <hash>.json meta file and the <hash>.body file, the hash is computed from
+	// the method, url and body of the request.
+	fixtureStore struct {
+		dir    string
+		replay bool
+	}
+	fixtureMeta struct {
+		Method      string      `json:"method"`
+		Url         string      `json:"url"`
+		RequestBody string      `json:"request_body,omitempty"`
+		StatusCode  int         `json:"status_code"`
+		Header      http.Header `json:"header"`
+	}
+)
+
+// FIXTURE_STORE is set by `test --record` and `test --replay`.
+var FIXTURE_STORE *fixtureStore
+
+const fixtureItemsFile = "items.json"
+
+func newFixtureStore(recordDir, replayDir string) (*fixtureStore, error) {
+	if recordDir != "" && replayDir != "" {
+		return nil, fmt.Errorf("--record and --replay can not be used together")
+	}
+	if recordDir != "" {
+		if err := os.MkdirAll(recordDir, 0755); err != nil {
+			return nil, fmt.Errorf("create fixture dir fail:%v", err)
+		}
+		return &fixtureStore{dir: recordDir}, nil
+	}
+	if replayDir != "" {
+		if _, err := os.Stat(replayDir); err != nil {
+			return nil, fmt.Errorf("open fixture dir fail:%v", err)
+		}
+		return &fixtureStore{dir: replayDir, replay: true}, nil
+	}
+	return nil, nil
+}
+
+func fixtureKey(method, url string, body []byte) string {
+	return MD5Hash(method + " " + url + "\n" + string(body))
+}
+
+func (f *fixtureStore) wrap(client *req.Client) {
+	client.WrapRoundTripFunc(func(rt req.RoundTripper) req.RoundTripFunc {
+		return func(request *req.Request) (*req.Response, error) {
+			if f.replay {
+				return f.load(request)
+			}
+			res, err := rt.RoundTrip(request)
+			if err == nil && res.Response != nil {
+				if saveErr := f.save(request, res); saveErr != nil {
+					LOGGER.Errorf("record %s fail:%v", request.RawURL, saveErr)
+				}
+			}
+			return res, err
+		}
+	})
+}
+
+func (f *fixtureStore) save(request *req.Request, res *req.Response) error {
+	key := fixtureKey(request.Method, request.RawURL, request.Body)
+	meta, err := json.MarshalIndent(fixtureMeta{
+		Method:      request.Method,
+		Url:         request.RawURL,
+		RequestBody: string(request.Body),
+		StatusCode:  res.StatusCode,
+		Header:      res.Header,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(path.Join(f.dir, key+".json"), meta, 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(path.Join(f.dir, key+".body"), res.Bytes(), 0644)
+}
+
+func (f *fixtureStore) load(request *req.Request) (*req.Response, error) {
+	key := fixtureKey(request.Method, request.RawURL, request.Body)
+	content, err := os.ReadFile(path.Join(f.dir, key+".json"))
+	if err != nil {
+		return nil, fmt.Errorf("no fixture for %s %s:%v", request.Method, request.RawURL, err)
+	}
+	meta := fixtureMeta{}
+	if err = json.Unmarshal(content, &meta); err != nil {
+		return nil, fmt.Errorf("decode fixture %s fail:%v", key, err)
+	}
+	body, err := os.ReadFile(path.Join(f.dir, key+".body"))
+	if err != nil {
+		return nil, fmt.Errorf("no fixture for %s %s:%v", request.Method, request.RawURL, err)
+	}
+	httpReq, err := http.NewRequest(request.Method, request.RawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	res := &req.Response{
+		Request: request,
+		Response: &http.Response{
+			Status:     fmt.Sprintf("%d %s", meta.StatusCode, http.StatusText(meta.StatusCode)),
+			StatusCode: meta.StatusCode,
+			Header:     meta.Header,
+			Body:       io.NopCloser(bytes.NewReader(body)),
+			Request:    httpReq,
+		},
+	}
+	if res.Header == nil {
+		res.Header = http.Header{}
+	}
+	_, err = res.ToBytes()
+	return res, err
+}
+
+// sortItems orders items by key, so the output of a channel is comparable.
+func sortItems(items []Item) {
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Mk < items[j].Mk
+	})
+}
+
+// writeItems stores items as the expected output of the fixtures.
+func (f *fixtureStore) writeItems(items []Item) error {
+	content, err := json.MarshalIndent(items, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path.Join(f.dir, fixtureItemsFile), content, 0644)
+}
+
+// diffItems compares items with the expected items stored in file, every
+// difference found is returned.
+func diffItems(file string, items []Item) ([]string, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read expected items fail:%v", err)
+	}
+	expected := []map[string]interface{}{}
+	if err = json.Unmarshal(content, &expected); err != nil {
+		return nil, fmt.Errorf("decode expected items fail:%v", err)
+	}
+	content, err = json.Marshal(items)
+	if err != nil {
+		return nil, err
+	}
+	actual := []map[string]interface{}{}
+	if err = json.Unmarshal(content, &actual); err != nil {
+		return nil, err
+	}
+	actualSet := map[string]map[string]interface{}{}
+	for _, item := range actual {
+		actualSet[fmt.Sprint(item["Mk"])] = item
+	}
+	diffs := []string{}
+	for _, item := range expected {
+		key := fmt.Sprint(item["Mk"])
+		got, ok := actualSet[key]
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("missing item: %s", key))
+			continue
+		}
+		delete(actualSet, key)
+		fields := []string{}
+		for field := range item {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			if field == "Id" {
+				continue
+			}
+			if !reflect.DeepEqual(item[field], got[field]) {
+				diffs = append(diffs, fmt.Sprintf("%s.%s: expect %v, got %v", key, field, item[field], got[field]))
+			}
+		}
+	}
+	unexpected := []string{}
+	for key := range actualSet {
+		unexpected = append(unexpected, key)
+	}
+	sort.Strings(unexpected)
+	for _, key := range unexpected {
+		diffs = append(diffs, fmt.Sprintf("unexpected item: %s", key))
+	}
+	return diffs, nil
+}
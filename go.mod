@@ -6,6 +6,8 @@ require (
 	github.com/BurntSushi/toml v0.4.1
 	github.com/Masterminds/sprig v2.22.0+incompatible
 	github.com/PuerkitoBio/goquery v1.8.1
+	github.com/andybalholm/cascadia v1.3.2
+	github.com/antchfx/xpath v1.3.8
 	github.com/chzyer/readline v1.5.1
 	github.com/extism/extism v0.4.0
 	github.com/gin-gonic/gin v1.10.0
@@ -22,6 +24,7 @@ require (
 	github.com/zouyx/agollo/v3 v3.4.5
 	golang.org/x/net v0.47.0
 	golang.org/x/text v0.31.0
+	golang.org/x/time v0.12.0
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
 	xorm.io/xorm v1.2.4
 )
@@ -50,7 +53,6 @@ require (
 	github.com/alecthomas/units v0.0.0-20210927113745-59d0afb8317a // indirect
 	github.com/alessio/shellescape v1.4.1 // indirect
 	github.com/andybalholm/brotli v1.2.0 // indirect
-	github.com/andybalholm/cascadia v1.3.2 // indirect
 	github.com/apache/thrift v0.13.0 // indirect
 	github.com/armon/circbuf v0.0.0-20150827004946-bbbad097214e // indirect
 	github.com/armon/go-metrics v0.0.0-20180917152333-f0300d1749da // indirect
@@ -320,7 +322,6 @@ require (
 	golang.org/x/sync v0.18.0 // indirect
 	golang.org/x/sys v0.38.0 // indirect
 	golang.org/x/term v0.37.0 // indirect
-	golang.org/x/time v0.12.0 // indirect
 	golang.org/x/tools v0.38.0 // indirect
 	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
 	google.golang.org/api v0.13.0 // indirect
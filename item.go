@@ -22,8 +22,26 @@ type (
 		Description *RssCdata `xml:"description" xorm:"'description' text"`
 		Thumb       string    `xml:"thumb,omitempty" xorm:"'thumb' text"`
 		Channel     string    `xml:"-" xorm:"'channel' text unique(mk_channel)"`
+		Hash        string    `xml:"-" xorm:"'hash' text"`
 		ukey        string    `xml:"-" xorm:"-"`
 	}
+	TocValidator struct {
+		Id           int64
+		Channel      string `xorm:"'channel' text notnull unique(channel_url)"`
+		Url          string `xorm:"'url' text notnull unique(channel_url)"`
+		ETag         string `xorm:"'etag' text"`
+		LastModified string `xorm:"'last_modified' text"`
+		// Templated is set for the urls rendered from a templated toc url
+		Templated bool `xorm:"'templated'"`
+	}
+	// DroppedItem is an item dropped by a filter, it is not requested again
+	// while the filter is configured.
+	DroppedItem struct {
+		Id      int64
+		Channel string `xorm:"'channel' text notnull unique(channel_mk)"`
+		Mk      string `xorm:"'mk' text notnull unique(channel_mk)"`
+		Filter  string `xorm:"'filter' text"`
+	}
 	Repository struct {
 		keySetCache *cache.Cache
 		engine      *xorm.Engine
@@ -60,12 +78,27 @@ func (c *RssCdata) String() string {
 	return c.Content
 }
 func (*Item) TableName() string { return "item" }
+func (*TocValidator) TableName() string { return "toc_validator" }
+func (*DroppedItem) TableName() string  { return "dropped_item" }
 func (i *Item) Key() string {
 	if i.ukey == "" {
 		i.ukey = i.Channel + ":" + i.Mk
 	}
 	return i.ukey
 }
+// contentHash is the hash of the rendered content of the item, pubDate is not
+// included since it may be rendered from the current time.
+func (i *Item) contentHash() string {
+	content := []string{}
+	for _, c := range []*RssCdata{i.Title, i.Link, i.Guid, i.Category, i.Description} {
+		if c == nil {
+			content = append(content, "")
+		} else {
+			content = append(content, c.Content)
+		}
+	}
+	return MD5Hash(strings.Join(append(content, i.Thumb), "\n"))
+}
 func clearItem(items []*Item) []*Item {
 	if len(items) < 1 {
 		return nil
@@ -150,6 +183,117 @@ func (r *Repository) Save(items []*Item) error {
 	return err
 }
 
+// Upsert inserts the new items and updates the stored items whose content hash
+// changed, the pubDate of an updated item is set to now when bumpPubDate is set.
+func (r *Repository) Upsert(items []*Item, bumpPubDate bool) (inserted, updated int, err error) {
+	newItems := []*Item{}
+	for _, i := range items {
+		stored := Item{}
+		ok, err := r.engine.Where("channel = ? and mk = ?", i.Channel, i.Mk).Get(&stored)
+		if err != nil {
+			return inserted, updated, err
+		}
+		if !ok {
+			newItems = append(newItems, i)
+			continue
+		}
+		if stored.Hash == "" {
+			stored.Hash = stored.contentHash()
+		}
+		if stored.Hash == i.Hash {
+			continue
+		}
+		cols := []string{"title", "link", "guid", "category", "description", "thumb", "hash"}
+		if bumpPubDate {
+			i.PubDate = time.Now()
+			cols = append(cols, "pubDate")
+		}
+		// nil cdata is skipped by xorm, store an empty content to clear it
+		update := *i
+		for _, c := range []**RssCdata{&update.Title, &update.Link, &update.Guid, &update.Category, &update.Description} {
+			if *c == nil {
+				*c = &RssCdata{}
+			}
+		}
+		if _, err = r.engine.ID(stored.Id).Cols(cols...).Update(&update); err != nil {
+			return inserted, updated, err
+		}
+		updated++
+	}
+	if err = r.Save(newItems); err != nil {
+		return inserted, updated, err
+	}
+	return len(newItems), updated, nil
+}
+
+func (r *Repository) FindValidator(channel, url string) (TocValidator, error) {
+	validator := TocValidator{}
+	_, err := r.engine.Where("channel = ? and url = ?", channel, url).Get(&validator)
+	return validator, err
+}
+
+func (r *Repository) SaveValidators(validators []*TocValidator) error {
+	for _, v := range validators {
+		stored := TocValidator{}
+		ok, err := r.engine.Where("channel = ? and url = ?", v.Channel, v.Url).Get(&stored)
+		if err != nil {
+			return err
+		}
+		if ok {
+			_, err = r.engine.ID(stored.Id).Cols("etag", "last_modified", "templated").Update(v)
+		} else {
+			_, err = r.engine.Insert(v)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PruneValidators removes the validators of the templated toc urls of channel
+// which are not in urls.
+func (r *Repository) PruneValidators(channel string, urls []string) error {
+	session := r.engine.Where("channel = ? and templated = ?", channel, true)
+	if len(urls) > 0 {
+		session = session.NotIn("url", urls)
+	}
+	_, err := session.Delete(&TocValidator{})
+	return err
+}
+
+// FindDrop returns the filter which dropped the item key of channel.
+func (r *Repository) FindDrop(channel, key string) (string, error) {
+	drop := DroppedItem{}
+	_, err := r.engine.Where("channel = ? and mk = ?", channel, key).Get(&drop)
+	return drop.Filter, err
+}
+
+// SaveDrops stores the drops decided with the keys of the toc page, a drop
+// decided after the extra pages may come from a page failed to render.
+func (r *Repository) SaveDrops(channel string, drops []FilterDrop) error {
+	for _, d := range drops {
+		if !d.toc {
+			continue
+		}
+		stored := DroppedItem{}
+		ok, err := r.engine.Where("channel = ? and mk = ?", channel, d.Item).Get(&stored)
+		if err != nil {
+			return err
+		}
+		drop := &DroppedItem{Channel: channel, Mk: d.Item, Filter: d.Filter}
+		if ok {
+			_, err = r.engine.ID(stored.Id).Cols("filter").Update(drop)
+		} else {
+			_, err = r.engine.Insert(drop)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func newRssCdata(content string) *RssCdata{
 	if len(content) > 0{
 		return &RssCdata{Content: content}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+func decodeJson(body []byte) (interface{}, error) {
+	var data interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// jsonPath walks the key path, a numeric key indexes an array and "*" expands
+// every element of an array or object.
+func jsonPath(data interface{}, keyPath []string) []interface{} {
+	current := []interface{}{data}
+	for _, key := range keyPath {
+		next := []interface{}{}
+		for _, node := range current {
+			switch v := node.(type) {
+			case map[string]interface{}:
+				if key == "*" {
+					for _, child := range v {
+						next = append(next, child)
+					}
+				} else if child, ok := v[key]; ok {
+					next = append(next, child)
+				}
+			case []interface{}:
+				if key == "*" {
+					next = append(next, v...)
+				} else if index, err := strconv.Atoi(key); err == nil {
+					if index < 0 {
+						index += len(v)
+					}
+					if index >= 0 && index < len(v) {
+						next = append(next, v[index])
+					}
+				}
+			}
+		}
+		current = next
+	}
+	return current
+}
+
+// jsonItems returns the item array selected by itemPath, a single object is
+// treated as a list with one item.
+func jsonItems(data interface{}, itemPath []string) []interface{} {
+	items := []interface{}{}
+	for _, node := range jsonPath(data, itemPath) {
+		if list, ok := node.([]interface{}); ok {
+			items = append(items, list...)
+		} else if node != nil {
+			items = append(items, node)
+		}
+	}
+	return items
+}
+
+func jsonValueToString(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case json.Number:
+		return value.String()
+	case bool:
+		return strconv.FormatBool(value)
+	case map[string]interface{}, []interface{}:
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Sprint(value)
+		}
+		return string(raw)
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+func (e *JsonElementSelector) getKey(data interface{}) interface{} {
+	res := []string{}
+	regexP := e.regex
+	if regexP == nil && e.Regex != "" {
+		var err error
+		if regexP, err = regexp.Compile(e.Regex); err != nil {
+			LOGGER.Errorf("compile regex %s fail:%v", e.Regex, err)
+			return ""
+		}
+	}
+	for _, node := range jsonPath(data, e.KeyPath) {
+		text := jsonValueToString(node)
+		if regexP != nil {
+			regexRes := regexP.FindStringSubmatch(text)
+			if len(regexRes) > 1 {
+				text = regexRes[1]
+			}
+		}
+		res = append(res, text)
+	}
+	switch len(res) {
+	case 0:
+		return ""
+	case 1:
+		return res[0]
+	default:
+		return res
+	}
+}
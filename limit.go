@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/imroc/req/v3"
+)
+
+const (
+	defaultTimeout      = 30
+	defaultMaxBodyBytes = 20 << 20
+)
+
+type limitedBody struct {
+	io.ReadCloser
+	url  string
+	read int64
+	max  int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if b.read > b.max {
+		return n, permanent(fmt.Errorf("response body of %s exceeds %d bytes", b.url, b.max))
+	}
+	return n, err
+}
+
+// timeout returns Timeout or ExtraTimeout of the rule, a zero value falls back
+// to the one of BaseConfig, ExtraTimeout falls back to Timeout.
+func (r *Rule) timeout(isExtraReq bool) time.Duration {
+	seconds := r.Timeout
+	if seconds <= 0 && BASE_CONF != nil {
+		seconds = BASE_CONF.Timeout
+	}
+	if isExtraReq {
+		if r.ExtraTimeout > 0 {
+			seconds = r.ExtraTimeout
+		} else if BASE_CONF != nil && BASE_CONF.ExtraTimeout > 0 {
+			seconds = BASE_CONF.ExtraTimeout
+		}
+	}
+	if seconds <= 0 {
+		seconds = defaultTimeout
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func (r *Rule) maxBodyBytes() int64 {
+	if r.MaxBodyBytes > 0 {
+		return int64(r.MaxBodyBytes)
+	}
+	if BASE_CONF != nil && BASE_CONF.MaxBodyBytes > 0 {
+		return int64(BASE_CONF.MaxBodyBytes)
+	}
+	return defaultMaxBodyBytes
+}
+
+// limitBody fails the responses of client whose body is larger than max.
+func limitBody(client *req.Client, max int64) {
+	client.GetTransport().WrapRoundTripFunc(func(rt http.RoundTripper) req.HttpRoundTripFunc {
+		return func(request *http.Request) (*http.Response, error) {
+			res, err := rt.RoundTrip(request)
+			if err != nil || res.Body == nil {
+				return res, err
+			}
+			if res.ContentLength > max {
+				res.Body.Close()
+				return nil, permanent(fmt.Errorf("response body of %s exceeds %d bytes: %d", request.URL, max, res.ContentLength))
+			}
+			res.Body = &limitedBody{ReadCloser: res.Body, url: request.URL.String(), max: max}
+			return res, nil
+		}
+	})
+}
@@ -28,9 +28,13 @@ var (
 	CONF_DIR     = ".config"
 	USER_DIR     string
 	BASE_CONF    *BaseConfig
-	Cmd          = kingpin.Arg("command", "action comand").Required().Enum("start", "stop", "status", "reload", "update", "ws", "log", "test")
+	Cmd          = kingpin.Arg("command", "action comand").Required().Enum("start", "stop", "status", "reload", "update", "ws", "log", "test", "verify")
 	CHANNEL_NAME = kingpin.Arg("channel", "command channel target").Default("").String()
 	OutputFile   = kingpin.Flag("output", "test output file path").Default("").Short('o').String()
+	RecordDir    = kingpin.Flag("record", "record the responses fetched by test into dir").Default("").String()
+	ReplayDir    = kingpin.Flag("replay", "serve the responses recorded in dir to test and verify").Default("").String()
+	ExpectFile   = kingpin.Flag("expect", "expected items of verify, <replay>/items.json by default").Default("").String()
+	Explain      = kingpin.Flag("explain", "report how the selectors of test match the pages").Bool()
 	WS_UPGRADER  = websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
@@ -185,6 +189,9 @@ func main() {
 	case "test":
 		channelTest(*CHANNEL_NAME)
 		return
+	case "verify":
+		channelVerify(*CHANNEL_NAME)
+		return
 	case "status":
 		pid, err := checkHealth()
 		if err != nil {
@@ -222,6 +229,9 @@ func main() {
 		LOGGER.Fatal(err)
 	}
 	service := NewService(repository, ruleConfig)
+	if MEDIA_STORE, err = newMediaStore(BASE_CONF.Media); err != nil {
+		LOGGER.Fatal(err)
+	}
 	gin.SetMode("release")
 	gin.DefaultWriter = LOGGER.Writer()
 	route := gin.Default()
@@ -240,35 +250,87 @@ func main() {
 	route.GET("/html", controller.GetHtmlChannelList)
 	route.GET("/html/:channel", controller.GetHtmlChannel)
 	route.GET("/html/:channel/:id", controller.GetHtmlChannelItem)
+	route.GET("/media/:hash", controller.GetMedia)
 	LOGGER.Infof("web2rss 开始服务: %d", os.Getpid())
 	if err = route.Run(BASE_CONF.Addr); err != nil {
 		LOGGER.Fatal(err)
 	}
 }
-func channelTest(channelName string) {
+// generateChannelItems runs the channel config file with the fixtures of
+// --record or --replay, the items are sorted by key.
+func generateChannelItems(channelName string) (*ChannelConf, []Item, error) {
 	if channelName == "" {
-		LOGGER.Error("<channel config file> is required for test")
-		return
+		return nil, nil, fmt.Errorf("<channel config file> is required for %s", *Cmd)
+	}
+	var err error
+	if FIXTURE_STORE, err = newFixtureStore(*RecordDir, *ReplayDir); err != nil {
+		return nil, nil, err
 	}
 	cconf, err := loadChanalConf(channelName)
 	if err != nil {
-		LOGGER.Error(err)
-		return
+		return nil, nil, err
 	}
 	err = cconf.CheckConf(nil)
 	if err != nil {
-		LOGGER.Error(err)
-		return
+		return nil, nil, err
 	}
+	cconf.Rule.explain = newExplainer()
 	items, err := cconf.Rule.GenerateItem()
 	if err != nil {
-		LOGGER.Error(err)
-		return
+		return &cconf, nil, err
 	}
 	itemList := make([]Item, len(items))
 	for i, d := range items {
 		itemList[i] = *d
 	}
+	sortItems(itemList)
+	return &cconf, itemList, nil
+}
+
+// channelVerify replays the fixtures of a channel and compares the items with
+// the expected ones, the process exits with 1 when they differ.
+func channelVerify(channelName string) {
+	if *ReplayDir == "" {
+		LOGGER.Fatal("--replay <fixture dir> is required for verify")
+	}
+	_, itemList, err := generateChannelItems(channelName)
+	if err != nil {
+		LOGGER.Fatal(err)
+	}
+	expectFile := *ExpectFile
+	if expectFile == "" {
+		expectFile = path.Join(*ReplayDir, fixtureItemsFile)
+	}
+	diffs, err := diffItems(expectFile, itemList)
+	if err != nil {
+		LOGGER.Fatal(err)
+	}
+	if len(diffs) > 0 {
+		for _, diff := range diffs {
+			LOGGER.Error(diff)
+		}
+		LOGGER.Fatalf("verify fail: %s, %d differences", channelName, len(diffs))
+	}
+	LOGGER.Infof("verify success: %s, %d items", channelName, len(itemList))
+}
+
+func channelTest(channelName string) {
+	cconf, itemList, err := generateChannelItems(channelName)
+	if err != nil {
+		LOGGER.Error(err)
+		if cconf != nil {
+			explainChannel(cconf)
+		}
+		os.Exit(1)
+	}
+	defer explainChannel(cconf)
+	if FIXTURE_STORE != nil && !FIXTURE_STORE.replay {
+		if err = FIXTURE_STORE.writeItems(itemList); err != nil {
+			LOGGER.Error(err)
+			return
+		}
+		LOGGER.Info("fixtures recorded: ", *RecordDir)
+	}
 	output, err := json.Marshal(itemList)
 	if err != nil {
 		LOGGER.Error(err)
@@ -276,6 +338,26 @@ func channelTest(channelName string) {
 	}
 	LOGGER.Infoln("生成条目：")
 	LOGGER.Infoln(string(output))
+	if failures := cconf.Rule.ItemFailures(); len(failures) > 0 {
+		LOGGER.Warnf("%d 个条目失败：", len(failures))
+		for _, failure := range failures {
+			LOGGER.Warnln(failure)
+		}
+	}
+	if drops := cconf.Rule.FilterDrops(); len(drops) > 0 {
+		filters := []string{}
+		dropMap := map[string][]string{}
+		for _, drop := range drops {
+			if _, ok := dropMap[drop.Filter]; !ok {
+				filters = append(filters, drop.Filter)
+			}
+			dropMap[drop.Filter] = append(dropMap[drop.Filter], drop.Item)
+		}
+		LOGGER.Infof("过滤 %d 个条目：", len(drops))
+		for _, filter := range filters {
+			LOGGER.Infof("%s: %s", filter, strings.Join(dropMap[filter], ", "))
+		}
+	}
 	rawBody, err := cconf.RssRenderItem(itemList)
 	if err != nil {
 		LOGGER.Error(err)
@@ -302,6 +384,21 @@ func channelTest(channelName string) {
 	}
 }
 
+// explainChannel reports the selectors with `test --explain`, the process exits
+// with 1 when a toc url fails or matches no item, or a Required key is empty.
+func explainChannel(cconf *ChannelConf) {
+	if cconf.Rule.explain == nil {
+		return
+	}
+	if *Explain {
+		LOGGER.Infoln("选择器：")
+		cconf.Rule.explain.report()
+	}
+	if failures := cconf.Rule.explain.failures(); len(failures) > 0 {
+		LOGGER.Fatalf("test fail: %s", strings.Join(failures, "; "))
+	}
+}
+
 func mainStop() {
 	time.Sleep(time.Microsecond * 100)
 	LOGGER.Infof("web2rss(%d): 停止服务", os.Getpid())
@@ -313,7 +410,7 @@ func (c *Controller) GetHealth(ctx *gin.Context) {
 }
 func (c *Controller) GetInfo(ctx *gin.Context) {
 	channelInfoList := c.service.GetChannelStatus()
-	ctx.JSON(200, gin.H{"data": channelInfoList, "status": 0, "message": "ok"})
+	ctx.JSON(200, gin.H{"data": channelInfoList, "proxies": GetProxyStatus(), "status": 0, "message": "ok"})
 }
 
 func (c *Controller) HandleSignal(ctx *gin.Context) {
@@ -437,6 +534,31 @@ func (c *Controller) GetRssChannel(ctx *gin.Context) {
 	ctx.Writer.Header().Set("Content-Type", "application/xml; charset=utf-8")
 	_, _ = ctx.Writer.Write(body)
 }
+func (c *Controller) GetMedia(ctx *gin.Context) {
+	hash := ctx.Param("hash")
+	meta, err := MEDIA_STORE.meta(hash)
+	if err != nil {
+		_ = ctx.AbortWithError(404, fmt.Errorf("media %s not found", hash))
+		return
+	}
+	channel, ok := c.service.GetChannel(meta.Channel)
+	if !ok {
+		_ = ctx.AbortWithError(404, fmt.Errorf("channelName %s not found", meta.Channel))
+		return
+	}
+	body, meta, err := MEDIA_STORE.get(channel, hash)
+	if err == errMediaTooLarge {
+		ctx.Redirect(302, meta.Url)
+		return
+	}
+	if err != nil {
+		_ = ctx.AbortWithError(502, err)
+		return
+	}
+	ctx.Header("Cache-Control", "public, max-age=604800")
+	ctx.Data(200, meta.ContentType, body)
+}
+
 func (c *Controller) GetHtmlChannelList(ctx *gin.Context) {
 	channelInfoList := c.service.GetChannelStatus()
 	ctx.Status(200)
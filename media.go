@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/imroc/req/v3"
+)
+
+const (
+	mediaModeProxy  = "proxy"
+	mediaModeInline = "inline"
+)
+
+type (
+	// MediaConf sets the media cache used by the channels whose MediaProxy is
+	// "proxy" or "inline". BaseUrl is the address of web2rss seen by the rss
+	// readers.
+	MediaConf struct {
+		Dir        string
+		BaseUrl    string
+		MaxFileMB  int
+		CacheMaxMB int
+	}
+	// mediaStore caches the images of the channels on disk, <hash> is the body
+	// and <hash>.json the mediaMeta of an image.
+	mediaStore struct {
+		conf      MediaConf
+		lock      sync.Mutex
+		fetchLock sync.Map
+		clients   map[string]*req.Client
+	}
+	mediaMeta struct {
+		Url         string `json:"url"`
+		Channel     string `json:"channel"`
+		ContentType string `json:"content_type"`
+	}
+)
+
+var (
+	MEDIA_STORE        *mediaStore
+	img_src_pattern    = regexp.MustCompile(`(<img\b[^>]*?\bsrc\s*=\s*)(['"])([^'"]+)(['"])`)
+	media_hash_pattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+	errMediaTooLarge   = fmt.Errorf("media is too large")
+)
+
+func newMediaStore(conf MediaConf) (*mediaStore, error) {
+	if err := os.MkdirAll(conf.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("create media dir fail:%v", err)
+	}
+	return &mediaStore{conf: conf, clients: map[string]*req.Client{}}, nil
+}
+
+func (m *mediaStore) maxFileBytes() int64 {
+	if m.conf.MaxFileMB <= 0 {
+		return 10 << 20
+	}
+	return int64(m.conf.MaxFileMB) << 20
+}
+
+func (m *mediaStore) cacheMaxBytes() int64 {
+	if m.conf.CacheMaxMB <= 0 {
+		return 512 << 20
+	}
+	return int64(m.conf.CacheMaxMB) << 20
+}
+
+// register stores the source of an image and returns its hash, the hash of
+// the same image differs between the channels since it is fetched with the
+// rule of the channel.
+func (m *mediaStore) register(channel, mediaUrl string) string {
+	hash := MD5Hash(channel + "\n" + mediaUrl)
+	metaFile := path.Join(m.conf.Dir, hash+".json")
+	if _, err := os.Stat(metaFile); err == nil {
+		now := time.Now()
+		_ = os.Chtimes(metaFile, now, now)
+		return hash
+	}
+	content, _ := json.Marshal(mediaMeta{Url: mediaUrl, Channel: channel})
+	if err := os.WriteFile(metaFile, content, 0644); err != nil {
+		LOGGER.Errorf("store media meta fail:%v", err)
+	}
+	return hash
+}
+
+func (m *mediaStore) meta(hash string) (*mediaMeta, error) {
+	if !media_hash_pattern.MatchString(hash) {
+		return nil, os.ErrNotExist
+	}
+	content, err := os.ReadFile(path.Join(m.conf.Dir, hash+".json"))
+	if err != nil {
+		return nil, err
+	}
+	meta := &mediaMeta{}
+	return meta, json.Unmarshal(content, meta)
+}
+
+// client returns the client fetching the images of channel, it sends the
+// Headers of the rule and a Referer of the channel link.
+func (m *mediaStore) client(cconf *ChannelConf) *req.Client {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	client, ok := m.clients[cconf.Desc.Title]
+	if !ok {
+		headers := map[string]string{"Referer": cconf.Desc.Link}
+		for k, v := range cconf.Rule.Headers {
+			headers[k] = v
+		}
+		client = cconf.Rule.newClient(headers)
+		m.clients[cconf.Desc.Title] = client
+	}
+	return client
+}
+
+// get returns the cached image of hash, it is fetched with the rule of cconf
+// when it is not cached.
+func (m *mediaStore) get(cconf *ChannelConf, hash string) ([]byte, *mediaMeta, error) {
+	meta, err := m.meta(hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	lock, _ := m.fetchLock.LoadOrStore(hash, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+	bodyFile := path.Join(m.conf.Dir, hash)
+	if body, err := os.ReadFile(bodyFile); err == nil && meta.ContentType != "" {
+		now := time.Now()
+		_ = os.Chtimes(bodyFile, now, now)
+		return body, meta, nil
+	}
+	res, err := cconf.Rule.send(&httpRequest{client: m.client(cconf), method: http.MethodGet, url: meta.Url})
+	if err != nil {
+		return nil, meta, err
+	}
+	body := res.Bytes()
+	if int64(len(body)) > m.maxFileBytes() {
+		return nil, meta, errMediaTooLarge
+	}
+	meta.ContentType = res.GetContentType()
+	if meta.ContentType == "" {
+		meta.ContentType = http.DetectContentType(body)
+	}
+	if err = os.WriteFile(bodyFile, body, 0644); err != nil {
+		return nil, meta, err
+	}
+	content, _ := json.Marshal(meta)
+	if err = os.WriteFile(path.Join(m.conf.Dir, hash+".json"), content, 0644); err != nil {
+		return nil, meta, err
+	}
+	m.evict()
+	return body, meta, nil
+}
+
+// evict removes the least recently served images with their meta files until
+// the cache fits in CacheMaxMB. The meta of an image never fetched is used when
+// its feed is rendered.
+func (m *mediaStore) evict() {
+	entries, err := os.ReadDir(m.conf.Dir)
+	if err != nil {
+		LOGGER.Errorf("read media dir fail:%v", err)
+		return
+	}
+	type cachedMedia struct {
+		hash     string
+		size     int64
+		bodyTime time.Time
+		metaTime time.Time
+	}
+	cached := map[string]*cachedMedia{}
+	total := int64(0)
+	for _, entry := range entries {
+		hash := strings.TrimSuffix(entry.Name(), ".json")
+		if entry.IsDir() || !media_hash_pattern.MatchString(hash) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		media, ok := cached[hash]
+		if !ok {
+			media = &cachedMedia{hash: hash}
+			cached[hash] = media
+		}
+		media.size += info.Size()
+		if hash == entry.Name() {
+			media.bodyTime = info.ModTime()
+		} else {
+			media.metaTime = info.ModTime()
+		}
+		total += info.Size()
+	}
+	if total <= m.cacheMaxBytes() {
+		return
+	}
+	medias := make([]*cachedMedia, 0, len(cached))
+	for _, media := range cached {
+		if media.bodyTime.IsZero() {
+			media.bodyTime = media.metaTime
+		}
+		medias = append(medias, media)
+	}
+	sort.Slice(medias, func(i, j int) bool {
+		return medias[i].bodyTime.Before(medias[j].bodyTime)
+	})
+	for _, media := range medias {
+		if total <= m.cacheMaxBytes() {
+			break
+		}
+		for _, name := range []string{media.hash, media.hash + ".json"} {
+			if err := os.Remove(path.Join(m.conf.Dir, name)); err != nil && !os.IsNotExist(err) {
+				LOGGER.Errorf("remove media cache fail:%v", err)
+			}
+		}
+		total -= media.size
+	}
+}
+
+func (m *mediaStore) mediaUrl(hash string) string {
+	u := strings.TrimSuffix(m.conf.BaseUrl, "/") + "/media/" + hash
+	if BASE_CONF != nil && BASE_CONF.Token != "" {
+		u += "?token=" + url.QueryEscape(BASE_CONF.Token)
+	}
+	return u
+}
+
+// rewrite returns the address of mediaUrl for the rss readers in the media
+// mode of cconf, mediaUrl is returned when it can not be rewritten.
+func (m *mediaStore) rewrite(cconf *ChannelConf, mediaUrl string) string {
+	if !strings.HasPrefix(mediaUrl, "http://") && !strings.HasPrefix(mediaUrl, "https://") {
+		return mediaUrl
+	}
+	hash := m.register(cconf.Desc.Title, mediaUrl)
+	if cconf.MediaProxy != mediaModeInline {
+		return m.mediaUrl(hash)
+	}
+	body, meta, err := m.get(cconf, hash)
+	if err != nil {
+		LOGGER.Errorf("inline media %s fail:%v", mediaUrl, err)
+		return mediaUrl
+	}
+	return "data:" + meta.ContentType + ";base64," + base64.StdEncoding.EncodeToString(body)
+}
+
+// rewriteMedia replaces the images of the description and the thumbnail of item
+// with the media cache.
+func (c *ChannelConf) rewriteMedia(item *Item) {
+	if MEDIA_STORE == nil || (c.MediaProxy != mediaModeProxy && c.MediaProxy != mediaModeInline) {
+		return
+	}
+	if item.Description != nil && item.Description.Content != "" {
+		item.Description.Content = img_src_pattern.ReplaceAllStringFunc(item.Description.Content, func(tag string) string {
+			match := img_src_pattern.FindStringSubmatch(tag)
+			return match[1] + match[2] + MEDIA_STORE.rewrite(c, match[3]) + match[4]
+		})
+	}
+	if item.Thumb != "" {
+		item.Thumb = MEDIA_STORE.rewrite(c, item.Thumb)
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/imroc/req/v3"
+	"golang.org/x/time/rate"
+)
+
+const (
+	robotsAgent   = "web2rss"
+	robotsExpired = time.Hour * 24
+	// a robots.txt failed to fetch allows every url until robotsRetry
+	robotsRetry   = time.Minute * 10
+	robotsTimeout = time.Second * 10
+)
+
+type (
+	// PolitenessConf limits the requests sent to a single host. The limit is
+	// shared by every channel requesting the same host.
+	PolitenessConf struct {
+		RequestsPerSecond float64
+		MaxInFlight       int
+		RespectRobots     bool
+	}
+	hostLimiter struct {
+		lock sync.Mutex
+		// confs is the politeness config of every channel requesting the host
+		confs         map[string]PolitenessConf
+		limiter       *rate.Limiter
+		maxInFlight   int
+		inFlight      int
+		released      chan struct{}
+		robots        *robotsRules
+		robotsExpire  time.Time
+		robotsLoading chan struct{}
+	}
+	robotsRule struct {
+		allow bool
+		path  string
+	}
+	robotsRules struct {
+		rules      []robotsRule
+		crawlDelay time.Duration
+	}
+)
+
+var (
+	hostLimiterLock sync.Mutex
+	hostLimiters    = map[string]*hostLimiter{}
+)
+
+// politeness returns the politeness config of the rule, a zero value of the
+// rule config falls back to the one of BaseConfig. A rule can only turn
+// RespectRobots on.
+func (r *Rule) politeness() PolitenessConf {
+	conf := PolitenessConf{}
+	if BASE_CONF != nil {
+		conf = BASE_CONF.Politeness
+	}
+	if r.Politeness != nil {
+		if r.Politeness.RequestsPerSecond > 0 {
+			conf.RequestsPerSecond = r.Politeness.RequestsPerSecond
+		}
+		if r.Politeness.MaxInFlight > 0 {
+			conf.MaxInFlight = r.Politeness.MaxInFlight
+		}
+		if r.Politeness.RespectRobots {
+			conf.RespectRobots = true
+		}
+	}
+	return conf
+}
+
+func getHostLimiter(host string) *hostLimiter {
+	hostLimiterLock.Lock()
+	defer hostLimiterLock.Unlock()
+	h, ok := hostLimiters[host]
+	if !ok {
+		h = &hostLimiter{
+			confs:    map[string]PolitenessConf{},
+			limiter:  rate.NewLimiter(rate.Inf, 1),
+			released: make(chan struct{}),
+		}
+		hostLimiters[host] = h
+	}
+	return h
+}
+
+// forgetHostLimits removes the config of channel from every host, so a reloaded
+// channel no longer holds the limits of its old config.
+func forgetHostLimits(channel string) {
+	hostLimiterLock.Lock()
+	defer hostLimiterLock.Unlock()
+	for _, h := range hostLimiters {
+		h.lock.Lock()
+		if _, ok := h.confs[channel]; ok {
+			delete(h.confs, channel)
+			h.update()
+		}
+		h.lock.Unlock()
+	}
+}
+
+// apply records the config of channel and applies the most restrictive
+// settings of every channel sharing the host.
+func (h *hostLimiter) apply(channel string, conf PolitenessConf) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if old, ok := h.confs[channel]; ok && old == conf {
+		return
+	}
+	h.confs[channel] = conf
+	h.update()
+}
+
+// update computes the limits from confs and the crawl delay of robots.txt, it
+// is called with h.lock held.
+func (h *hostLimiter) update() {
+	limit, maxInFlight := rate.Inf, 0
+	for _, conf := range h.confs {
+		if conf.RequestsPerSecond > 0 && rate.Limit(conf.RequestsPerSecond) < limit {
+			limit = rate.Limit(conf.RequestsPerSecond)
+		}
+		if conf.MaxInFlight > 0 && (maxInFlight == 0 || conf.MaxInFlight < maxInFlight) {
+			maxInFlight = conf.MaxInFlight
+		}
+	}
+	if h.robots != nil && h.robots.crawlDelay > 0 {
+		if delay := rate.Every(h.robots.crawlDelay); delay < limit {
+			limit = delay
+		}
+	}
+	if limit != h.limiter.Limit() {
+		h.limiter.SetLimit(limit)
+	}
+	if maxInFlight != h.maxInFlight {
+		h.maxInFlight = maxInFlight
+		close(h.released)
+		h.released = make(chan struct{})
+	}
+}
+
+// acquire waits for a free slot and the rate limiter of the host.
+func (h *hostLimiter) acquire(ctx context.Context) error {
+	for {
+		h.lock.Lock()
+		if h.maxInFlight <= 0 || h.inFlight < h.maxInFlight {
+			h.inFlight++
+			h.lock.Unlock()
+			break
+		}
+		released := h.released
+		h.lock.Unlock()
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if err := h.limiter.Wait(ctx); err != nil {
+		h.release()
+		return err
+	}
+	return nil
+}
+
+func (h *hostLimiter) release() {
+	h.lock.Lock()
+	h.inFlight--
+	close(h.released)
+	h.released = make(chan struct{})
+	h.lock.Unlock()
+}
+
+// robotsRules returns the cached robots.txt of the host, it is fetched outside
+// of h.lock so the other requests to the host are not blocked meanwhile.
+func (h *hostLimiter) robotsRules(ctx context.Context, client *req.Client, u *url.URL) *robotsRules {
+	h.lock.Lock()
+	for h.robotsLoading != nil {
+		loading := h.robotsLoading
+		h.lock.Unlock()
+		select {
+		case <-loading:
+		case <-ctx.Done():
+			return &robotsRules{}
+		}
+		h.lock.Lock()
+	}
+	if h.robots != nil && time.Now().Before(h.robotsExpire) {
+		robots := h.robots
+		h.lock.Unlock()
+		return robots
+	}
+	loading := make(chan struct{})
+	h.robotsLoading = loading
+	h.lock.Unlock()
+
+	robots, expired := fetchRobots(client, u)
+	h.lock.Lock()
+	h.robots, h.robotsExpire, h.robotsLoading = robots, time.Now().Add(expired), nil
+	h.update()
+	h.lock.Unlock()
+	close(loading)
+	return robots
+}
+
+// fetchRobots returns the robots.txt of the host of u and how long it is kept,
+// a failed fetch allows every url until robotsRetry.
+func fetchRobots(client *req.Client, u *url.URL) (*robotsRules, time.Duration) {
+	robotsUrl := u.Scheme + "://" + u.Host + "/robots.txt"
+	ctx, cancel := context.WithTimeout(context.Background(), robotsTimeout)
+	defer cancel()
+	res, err := client.R().SetContext(ctx).Get(robotsUrl)
+	switch {
+	case err != nil:
+		LOGGER.Errorf("fetch %s fail:%v", robotsUrl, err)
+		return &robotsRules{}, robotsRetry
+	case res.IsSuccessState():
+		return parseRobots(res.String(), robotsAgent), robotsExpired
+	case res.StatusCode >= 500:
+		LOGGER.Errorf("fetch %s fail:%d", robotsUrl, res.StatusCode)
+		return &robotsRules{}, robotsRetry
+	default:
+		// no robots.txt
+		return &robotsRules{}, robotsExpired
+	}
+}
+
+// waitHost blocks until the politeness settings allow a request to rawUrl, the
+// returned function must be called when the request is finished.
+func (r *Rule) waitHost(ctx context.Context, client *req.Client, rawUrl string) (func(), error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil || u.Host == "" {
+		return func() {}, nil
+	}
+	conf := r.politeness()
+	h := getHostLimiter(u.Host)
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if conf.RespectRobots {
+		if robots := h.robotsRules(ctx, client, u); !robots.allowed(u.RequestURI()) {
+			return nil, permanent(fmt.Errorf("disallowed by robots.txt: %s", rawUrl))
+		}
+	}
+	h.apply(r.channel, conf)
+	if err = h.acquire(ctx); err != nil {
+		return nil, err
+	}
+	return h.release, nil
+}
+
+// parseRobots reads the group of agent, or the "*" group when agent is not
+// listed in robots.txt.
+func parseRobots(content, agent string) *robotsRules {
+	groups := map[string]*robotsRules{}
+	current := []*robotsRules{}
+	inAgents := false
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+		switch key {
+		case "user-agent":
+			if !inAgents {
+				current = []*robotsRules{}
+			}
+			inAgents = true
+			name := strings.ToLower(value)
+			if groups[name] == nil {
+				groups[name] = &robotsRules{}
+			}
+			current = append(current, groups[name])
+		case "allow", "disallow":
+			inAgents = false
+			if value == "" {
+				continue
+			}
+			for _, g := range current {
+				g.rules = append(g.rules, robotsRule{allow: key == "allow", path: value})
+			}
+		case "crawl-delay":
+			inAgents = false
+			seconds, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			for _, g := range current {
+				g.crawlDelay = time.Duration(seconds * float64(time.Second))
+			}
+		}
+	}
+	for name, g := range groups {
+		if name != "*" && strings.Contains(strings.ToLower(agent), name) {
+			return g
+		}
+	}
+	if g, ok := groups["*"]; ok {
+		return g
+	}
+	return &robotsRules{}
+}
+
+// allowed applies the longest matching rule, allow wins on equal length.
+func (rules *robotsRules) allowed(path string) bool {
+	allow, matched := true, -1
+	for _, rule := range rules.rules {
+		if !robotsMatch(rule.path, path) {
+			continue
+		}
+		if len(rule.path) > matched || (len(rule.path) == matched && rule.allow) {
+			allow, matched = rule.allow, len(rule.path)
+		}
+	}
+	return allow
+}
+
+func robotsMatch(pattern, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	pattern = strings.TrimSuffix(pattern, "$")
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	rest := path[len(parts[0]):]
+	for _, part := range parts[1:] {
+		i := strings.Index(rest, part)
+		if i < 0 {
+			return false
+		}
+		rest = rest[i+len(part):]
+	}
+	if anchored {
+		last := parts[len(parts)-1]
+		return rest == "" || (len(parts) > 1 && strings.HasSuffix(path, last))
+	}
+	return true
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	proxyMinBackoff = time.Second * 30
+	proxyMaxBackoff = time.Minute * 30
+)
+
+type (
+	// proxyPool rotates the requests of the channels using the pool through its
+	// proxies, a failing proxy is skipped for a backoff growing with its
+	// consecutive failures.
+	proxyPool struct {
+		lock    sync.Mutex
+		name    string
+		proxies []*poolProxy
+		next    int
+	}
+	poolProxy struct {
+		url         *url.URL
+		raw         string
+		successes   int
+		failures    int
+		consecutive int
+		bannedUntil time.Time
+		lastError   string
+	}
+	ProxyStatus struct {
+		Pool        string    `json:"pool"`
+		Proxy       string    `json:"proxy"`
+		Successes   int       `json:"successes"`
+		Failures    int       `json:"failures"`
+		Healthy     bool      `json:"healthy"`
+		BannedUntil time.Time `json:"banned_until,omitempty"`
+		LastError   string    `json:"last_error,omitempty"`
+	}
+	proxyCtxKey struct{}
+)
+
+var (
+	proxyPoolLock           sync.Mutex
+	proxyPools              = map[string]*proxyPool{}
+	defaultProxyBanStatuses = []int{http.StatusForbidden, http.StatusProxyAuthRequired, http.StatusTooManyRequests}
+)
+
+// getProxyPool returns the pool named name of BaseConfig.ProxyPools, nil is
+// returned when the pool is not defined.
+func getProxyPool(name string) *proxyPool {
+	if name == "" || BASE_CONF == nil {
+		return nil
+	}
+	proxyPoolLock.Lock()
+	defer proxyPoolLock.Unlock()
+	if pool, ok := proxyPools[name]; ok {
+		return pool
+	}
+	rawList, ok := BASE_CONF.ProxyPools[name]
+	if !ok || len(rawList) == 0 {
+		LOGGER.Errorf("proxy pool %s is not defined", name)
+		return nil
+	}
+	pool := &proxyPool{name: name}
+	for _, raw := range rawList {
+		u, err := url.Parse(raw)
+		if err != nil {
+			LOGGER.Errorf("parse proxy %s of pool %s fail:%v", raw, name, err)
+			continue
+		}
+		pool.proxies = append(pool.proxies, &poolProxy{url: u, raw: u.Redacted()})
+	}
+	if len(pool.proxies) == 0 {
+		return nil
+	}
+	proxyPools[name] = pool
+	return pool
+}
+
+// pick returns the next healthy proxy, or the one recovering first when all
+// the proxies are failing.
+func (p *proxyPool) pick() *poolProxy {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	for i := 0; i < len(p.proxies); i++ {
+		proxy := p.proxies[(p.next+i)%len(p.proxies)]
+		if !proxy.bannedUntil.After(now) {
+			p.next = (p.next + i + 1) % len(p.proxies)
+			return proxy
+		}
+	}
+	first := p.proxies[0]
+	for _, proxy := range p.proxies[1:] {
+		if proxy.bannedUntil.Before(first.bannedUntil) {
+			first = proxy
+		}
+	}
+	return first
+}
+
+func (p *proxyPool) success(proxy *poolProxy) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	proxy.successes++
+	proxy.consecutive = 0
+	proxy.bannedUntil = time.Time{}
+}
+
+func (p *proxyPool) fail(proxy *poolProxy, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	proxy.failures++
+	proxy.consecutive++
+	proxy.lastError = err.Error()
+	backoff := proxyMinBackoff << (proxy.consecutive - 1)
+	if backoff > proxyMaxBackoff || backoff <= 0 {
+		backoff = proxyMaxBackoff
+	}
+	proxy.bannedUntil = time.Now().Add(backoff)
+	LOGGER.Infof("proxy %s of pool %s is skipped for %v:%v", proxy.raw, p.name, backoff, err)
+}
+
+// proxyFunc is the proxy of the clients using the pool, the proxy chosen by
+// sendOnce is read from the request context.
+func (p *proxyPool) proxyFunc(request *http.Request) (*url.URL, error) {
+	if proxy, ok := request.Context().Value(proxyCtxKey{}).(*poolProxy); ok {
+		return proxy.url, nil
+	}
+	return p.pick().url, nil
+}
+
+func (p *proxyPool) status() []ProxyStatus {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	statusList := make([]ProxyStatus, len(p.proxies))
+	for i, proxy := range p.proxies {
+		statusList[i] = ProxyStatus{
+			Pool:      p.name,
+			Proxy:     proxy.raw,
+			Successes: proxy.successes,
+			Failures:  proxy.failures,
+			Healthy:   !proxy.bannedUntil.After(now),
+			LastError: proxy.lastError,
+		}
+		if !statusList[i].Healthy {
+			statusList[i].BannedUntil = proxy.bannedUntil
+		}
+	}
+	return statusList
+}
+
+// GetProxyStatus returns the health of the proxies of the pools in use.
+func GetProxyStatus() []ProxyStatus {
+	proxyPoolLock.Lock()
+	pools := make([]*proxyPool, 0, len(proxyPools))
+	for _, pool := range proxyPools {
+		pools = append(pools, pool)
+	}
+	proxyPoolLock.Unlock()
+	sort.Slice(pools, func(i, j int) bool {
+		return pools[i].name < pools[j].name
+	})
+	statusList := []ProxyStatus{}
+	for _, pool := range pools {
+		statusList = append(statusList, pool.status()...)
+	}
+	return statusList
+}
+
+// proxy returns the proxy of the rule, Rule.Proxy overrides HttpProxy of the
+// base config.
+func (r *Rule) proxy() string {
+	if r.NoProxy {
+		return ""
+	}
+	if r.Proxy != "" {
+		return r.Proxy
+	}
+	return proxyUrl
+}
+
+func (r *Rule) proxyPool() *proxyPool {
+	if r.NoProxy {
+		return nil
+	}
+	return getProxyPool(r.ProxyPool)
+}
+
+// withPoolProxy chooses the proxy of a request when the rule uses a pool, the
+// returned function records the result of the request.
+func (r *Rule) withPoolProxy(ctx context.Context) (context.Context, func(err error)) {
+	pool := r.proxyPool()
+	if pool == nil {
+		return ctx, func(error) {}
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	proxy := pool.pick()
+	return context.WithValue(ctx, proxyCtxKey{}, proxy), func(err error) {
+		switch {
+		case err == nil:
+			pool.success(proxy)
+		case errors.Is(err, context.Canceled), err == errNotModified:
+		case isProxyBan(err):
+			pool.fail(proxy, err)
+		default:
+			var statusErr *httpStatusError
+			if !errors.As(err, &statusErr) {
+				// connection error
+				pool.fail(proxy, err)
+			} else {
+				pool.success(proxy)
+			}
+		}
+	}
+}
+
+func proxyBanStatuses() []int {
+	if BASE_CONF != nil && len(BASE_CONF.ProxyBanStatusCodes) > 0 {
+		return BASE_CONF.ProxyBanStatusCodes
+	}
+	return defaultProxyBanStatuses
+}
+
+// isProxyBan reports whether err is a status showing the proxy is banned.
+func isProxyBan(err error) bool {
+	var statusErr *httpStatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	for _, code := range proxyBanStatuses() {
+		if statusErr.statusCode == code {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"math"
+	"regexp"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"golang.org/x/net/html"
+)
+
+var (
+	readabilityUnlikely = regexp.MustCompile(`(?i)banner|breadcrumbs|combx|comment|community|disqus|extra|foot|header|menu|related|remark|rss|share|shoutbox|sidebar|skyscraper|sponsor|ad-break|agegate|pagination|pager|popup|nav`)
+	readabilityMaybe    = regexp.MustCompile(`(?i)and|article|body|column|main|shadow|content`)
+	readabilityPositive = regexp.MustCompile(`(?i)article|body|content|entry|hentry|main|page|post|text|blog|story|正文|内容`)
+	readabilityNegative = regexp.MustCompile(`(?i)hidden|combx|comment|com-|contact|foot|footer|footnote|masthead|media|meta|outbrain|promo|related|scroll|shoutbox|sidebar|sponsor|shopping|tags|tool|widget|nav|share`)
+	readabilityCommas   = regexp.MustCompile(`[,，、。；;]`)
+)
+
+// autoContent picks the main article of doc with a readability like scoring and
+// returns the keys content, image, author and published. Relative urls are
+// resolved against pageUrl. The document is modified.
+func autoContent(doc *goquery.Document, pageUrl string) map[string]interface{} {
+	result := map[string]interface{}{
+		"content":   "",
+		"image":     autoImage(doc),
+		"author":    autoAuthor(doc),
+		"published": autoPublished(doc),
+	}
+
+	doc.Find("script,style,noscript,iframe,form,nav,header,footer,aside,button,input,select,textarea,svg").Remove()
+	doc.Find("*").Each(func(_ int, s *goquery.Selection) {
+		if goquery.NodeName(s) == "body" || goquery.NodeName(s) == "html" {
+			return
+		}
+		match := s.AttrOr("class", "") + " " + s.AttrOr("id", "")
+		if readabilityUnlikely.MatchString(match) && !readabilityMaybe.MatchString(match) {
+			s.Remove()
+		}
+	})
+
+	scores := map[*html.Node]float64{}
+	candidates := []*html.Node{}
+	addScore := func(s *goquery.Selection, score float64) {
+		if s.Length() == 0 {
+			return
+		}
+		node := s.Get(0)
+		if node.Type != html.ElementNode || node.Data == "body" || node.Data == "html" {
+			return
+		}
+		if _, ok := scores[node]; !ok {
+			scores[node] = initScore(s)
+			candidates = append(candidates, node)
+		}
+		scores[node] += score
+	}
+	doc.Find("p,pre,td,blockquote,section,div").Each(func(_ int, s *goquery.Selection) {
+		if goquery.NodeName(s) == "div" && s.Find("p,div,pre,blockquote,table,ul,ol").Length() > 0 {
+			// only divs used as paragraphs are scored
+			return
+		}
+		text := strings.TrimSpace(s.Text())
+		length := len([]rune(text))
+		if length < 25 {
+			return
+		}
+		score := 1 + float64(len(readabilityCommas.FindAllString(text, -1))) + math.Min(float64(length)/100, 3)
+		addScore(s.Parent(), score)
+		addScore(s.Parent().Parent(), score/2)
+	})
+
+	var top *html.Node
+	topScore := 0.0
+	for _, node := range candidates {
+		s := doc.FindNodes(node)
+		score := scores[node] * (1 - linkDensity(s))
+		if top == nil || score > topScore {
+			top, topScore = node, score
+		}
+	}
+	var content *goquery.Selection
+	if top == nil {
+		content = doc.Find("body")
+	} else {
+		content = doc.FindNodes(top)
+	}
+	content.Find("img").Each(func(_ int, s *goquery.Selection) {
+		for _, attr := range []string{"data-src", "data-original", "src"} {
+			if src, ok := s.Attr(attr); ok && src != "" {
+				s.SetAttr("src", resolveUrl(pageUrl, src))
+				break
+			}
+		}
+	})
+	content.Find("a[href]").Each(func(_ int, s *goquery.Selection) {
+		s.SetAttr("href", resolveUrl(pageUrl, s.AttrOr("href", "")))
+	})
+	if contentHtml, err := content.Html(); err == nil {
+		result["content"] = strings.TrimSpace(contentHtml)
+	}
+	if result["image"] == "" {
+		result["image"] = content.Find("img[src]").First().AttrOr("src", "")
+	}
+	if image := result["image"].(string); image != "" {
+		result["image"] = resolveUrl(pageUrl, image)
+	}
+	return result
+}
+
+func initScore(s *goquery.Selection) float64 {
+	score := 0.0
+	switch goquery.NodeName(s) {
+	case "article":
+		score += 10
+	case "div":
+		score += 5
+	case "pre", "td", "blockquote", "section":
+		score += 3
+	case "address", "ol", "ul", "dl", "dd", "dt", "li", "form":
+		score -= 3
+	case "h1", "h2", "h3", "h4", "h5", "h6", "th":
+		score -= 5
+	}
+	for _, attr := range []string{"class", "id"} {
+		value := s.AttrOr(attr, "")
+		if value == "" {
+			continue
+		}
+		if readabilityNegative.MatchString(value) {
+			score -= 25
+		}
+		if readabilityPositive.MatchString(value) {
+			score += 25
+		}
+	}
+	return score
+}
+
+func linkDensity(s *goquery.Selection) float64 {
+	textLength := len([]rune(s.Text()))
+	if textLength == 0 {
+		return 0
+	}
+	linkLength := 0
+	s.Find("a").Each(func(_ int, a *goquery.Selection) {
+		linkLength += len([]rune(a.Text()))
+	})
+	return float64(linkLength) / float64(textLength)
+}
+
+func metaContent(doc *goquery.Document, selectors ...string) string {
+	for _, selector := range selectors {
+		if value := strings.TrimSpace(doc.Find(selector).First().AttrOr("content", "")); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func autoImage(doc *goquery.Document) string {
+	return metaContent(doc, `meta[property="og:image"]`, `meta[name="twitter:image"]`, `meta[itemprop="image"]`)
+}
+
+func autoAuthor(doc *goquery.Document) string {
+	if author := metaContent(doc, `meta[name="author"]`, `meta[property="article:author"]`, `meta[name="byl"]`); author != "" {
+		return author
+	}
+	for _, selector := range []string{`[itemprop="author"]`, `[rel="author"]`, `.byline`, `.author`} {
+		if author := strings.TrimSpace(doc.Find(selector).First().Text()); author != "" {
+			return strings.Join(strings.Fields(author), " ")
+		}
+	}
+	return ""
+}
+
+// autoPublished returns the publish date in RFC3339 when the format is known.
+func autoPublished(doc *goquery.Document) string {
+	published := metaContent(doc,
+		`meta[property="article:published_time"]`,
+		`meta[itemprop="datePublished"]`,
+		`meta[name="pubdate"]`,
+		`meta[name="publishdate"]`,
+		`meta[name="date"]`)
+	if published == "" {
+		published = doc.Find("time[datetime]").First().AttrOr("datetime", "")
+	}
+	return normalizeFeedDate(published)
+}
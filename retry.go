@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+type (
+	// RetryConf is the retry policy of every request of a rule, Backoff and
+	// MaxBackoff are in seconds.
+	RetryConf struct {
+		Attempts    int
+		Backoff     int
+		MaxBackoff  int
+		StatusCodes []int
+	}
+	httpStatusError struct {
+		url        string
+		statusCode int
+		retryAfter time.Duration
+	}
+	// permanentError is an error a retry can not fix, such as a url disallowed
+	// by robots.txt or a body over the size limit.
+	permanentError struct {
+		err error
+	}
+)
+
+var defaultRetryStatusCodes = []int{
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("%s: unexpected status %d %s", e.url, e.statusCode, http.StatusText(e.statusCode))
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+func permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+func newHttpStatusError(url string, res *http.Response) *httpStatusError {
+	return &httpStatusError{
+		url:        url,
+		statusCode: res.StatusCode,
+		retryAfter: parseRetryAfter(res.Header.Get("Retry-After")),
+	}
+}
+
+// parseRetryAfter reads delay-seconds or an http date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+func (c RetryConf) attempts() int {
+	if c.Attempts < 1 {
+		return 5
+	}
+	return c.Attempts
+}
+
+// shouldRetry retries the transport errors and the configured status codes.
+func (c RetryConf) shouldRetry(err error) bool {
+	if err == nil || err == errNotModified || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var permErr *permanentError
+	if errors.As(err, &permErr) {
+		return false
+	}
+	var statusErr *httpStatusError
+	if !errors.As(err, &statusErr) {
+		return isTransportError(err)
+	}
+	statusCodes := c.StatusCodes
+	if statusCodes == nil {
+		statusCodes = defaultRetryStatusCodes
+	}
+	for _, code := range statusCodes {
+		if code == statusErr.statusCode {
+			return true
+		}
+	}
+	return false
+}
+
+// isTransportError reports whether err is a timeout or a network failure. The
+// *url.Error returned by the http client wraps every error of a round trip, so
+// the error it wraps is checked instead.
+func isTransportError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return true
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// delay is the exponential backoff with jitter before the next attempt, a
+// Retry-After header of the response is respected up to MaxBackoff.
+func (c RetryConf) delay(attempt int, err error) time.Duration {
+	backoff := time.Duration(c.Backoff) * time.Second
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	maxBackoff := time.Duration(c.MaxBackoff) * time.Second
+	if maxBackoff <= 0 {
+		maxBackoff = time.Minute
+	}
+	d := backoff << attempt
+	if d > maxBackoff || d <= 0 {
+		d = maxBackoff
+	}
+	d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+	if statusErr, ok := err.(*httpStatusError); ok && statusErr.retryAfter > d {
+		d = statusErr.retryAfter
+		if d > maxBackoff {
+			d = maxBackoff
+		}
+	}
+	return d
+}
@@ -1,11 +1,96 @@
 package main
 
 import (
-	"os/user"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
 	"regexp"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+	"golang.org/x/text/transform"
+	"xorm.io/xorm"
 )
 
+func newTestRepository(t *testing.T) *Repository {
+	engine, err := xorm.NewEngine("sqlite3", "file::memory:?cache=shared&_test="+t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { engine.Close() })
+	repository := newRepository(engine)
+	if err = (&Config{}).Check(repository); err != nil {
+		t.Fatal(err)
+	}
+	return repository
+}
+
+func newTestChannel(t *testing.T, rule Rule, repository *Repository) *ChannelConf {
+	if rule.TemplateConfig.Title == "" {
+		rule.TemplateConfig = ItemTemplate{Title: "{{.title}}", Link: "{{.link}}",
+			PubDate: "2022-02-15T00:00:00Z"}
+	}
+	if rule.Key == "" {
+		rule.Key = "link"
+	}
+	cconf := &ChannelConf{Desc: FeedDesc{Title: t.Name()}, Rule: rule}
+	if err := cconf.CheckConf(repository); err != nil {
+		t.Fatal(err)
+	}
+	return cconf
+}
+
+// newPagedServer serves pageCount toc pages with two items each, linked by a.next
+func newPagedServer(pageCount int) (*httptest.Server, *int) {
+	requestCount := new(int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requestCount++
+		page := 1
+		fmt.Sscanf(r.URL.Query().Get("p"), "%d", &page)
+		fmt.Fprint(w, "<html><body><ul>")
+		for i := 0; i < 2; i++ {
+			fmt.Fprintf(w, `<li><a href="/item/%d-%d">item %d-%d</a></li>`, page, i, page, i)
+		}
+		fmt.Fprint(w, "</ul>")
+		if page < pageCount {
+			fmt.Fprintf(w, `<a class="next" href="?p=%d">next</a>`, page+1)
+		}
+		fmt.Fprint(w, "</body></html>")
+	}))
+	return server, requestCount
+}
+
+func pagedRule(tocUrl string, maxPages int) Rule {
+	return Rule{
+		TocUrl:           tocUrl,
+		ItemSelector:     "li",
+		NextPageSelector: ElementSelector{Selector: "a.next"},
+		MaxPages:         maxPages,
+		KeyParseConf: map[string]ElementSelector{
+			"link":  {Selector: "a", Attr: "href"},
+			"title": {Selector: "a"},
+		},
+	}
+}
+
 func TestSelector(t *testing.T) {
 	regexRes := regexp.MustCompile(`(\d{4}-\d+-\d+ \d+:\d+)`).FindStringSubmatch(`本文由&nbsp;
 	     &nbsp;于&nbsp;2022-2-15 8:12 发布在&nbsp;
@@ -30,21 +115,1473 @@ func TestCurrentTimeDesc(t *testing.T){
 	testT("2021-8-19")
 }
 
-func TestGenerateItem(t *testing.T){
-	u, err := user.Current()
+func TestGenerateItem(t *testing.T) {
+	FIXTURE_STORE = &fixtureStore{dir: "testdata/555x", replay: true}
+	defer func() { FIXTURE_STORE = nil }()
+	cconf, err := loadChanalConf("conf/555x.toml")
 	if err != nil {
-		t.Fatal(err.Error())
-		return
+		t.Fatal(err)
+	}
+	if err = cconf.CheckConf(nil); err != nil {
+		t.Fatal(err)
+	}
+	items, err := cconf.Rule.GenerateItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	itemList := make([]Item, len(items))
+	for i, item := range items {
+		itemList[i] = *item
+	}
+	diffs, err := diffItems("testdata/555x/items.json", itemList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, diff := range diffs {
+		t.Error(diff)
+	}
+}
+
+func TestFixtureRecord(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/a/1" {
+			// fetched by the http module of the plugin
+			w.Header().Set("Content-Type", "text/html; charset=gbk")
+			body, _, _ := transform.Bytes(simplifiedchinese.GBK.NewEncoder(), []byte(`<p>正文</p>`))
+			w.Write(body)
+			return
+		}
+		fmt.Fprint(w, `<ul><li><a href="/a/1">第一篇</a></li></ul>`)
+	}))
+	dir := t.TempDir()
+	plugin := path.Join(dir, "http.lua")
+	if err := os.WriteFile(plugin, []byte(`local http = require("http")
+function GetContent(url)
+  local res, err = http.client():do_request(http.request("GET", url))
+  if err then return nil, err end
+  return '{"content":"' .. string.match(res.body, "<p>(.-)</p>") .. '"}', nil
+end
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rule := Rule{
+		TocUrl:              server.URL + "/list",
+		ItemSelector:        "li",
+		KeyParseConf:        map[string]ElementSelector{"link": {Selector: "a", Attr: "href"}, "title": {Selector: "a"}},
+		ExtraSource:         server.URL + "{{.link}}",
+		ExtraKeyParsePlugin: plugin,
+		TemplateConfig:      ItemTemplate{Title: "{{.title}} {{.content}}", Link: "{{.link}}", PubDate: "2022-02-15T00:00:00Z"},
+	}
+	FIXTURE_STORE = &fixtureStore{dir: dir}
+	defer func() { FIXTURE_STORE = nil }()
+	recorded, err := newTestChannel(t, rule, nil).Rule.GenerateItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+
+	FIXTURE_STORE = &fixtureStore{dir: dir, replay: true}
+	replayed, err := newTestChannel(t, rule, nil).Rule.GenerateItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recorded) != 1 || len(replayed) != 1 || replayed[0].Title.String() != recorded[0].Title.String() {
+		t.Errorf("unexpected items: %+v, %+v", recorded, replayed)
+	}
+	if len(replayed) == 1 && strings.TrimSpace(replayed[0].Title.String()) != "第一篇 正文" {
+		t.Errorf("the page of the plugin is not replayed and decoded: %s", replayed[0].Title.String())
+	}
+}
+
+func TestJsonElementSelector(t *testing.T) {
+	data, err := decodeJson([]byte(`{"data":{"list":[
+		{"id":1024,"title":"第一章 开始","tags":["a","b"]},
+		{"id":1025,"title":"第二章 结束","tags":[]}
+	]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := jsonItems(data, []string{"data", "list"})
+	if len(items) != 2 {
+		t.Fatalf("expect 2 items, got %d", len(items))
+	}
+	id := JsonElementSelector{KeyPath: []string{"id"}}
+	if v := id.getKey(items[0]); v != "1024" {
+		t.Errorf("id: %v", v)
+	}
+	title := JsonElementSelector{KeyPath: []string{"title"}, Regex: `^(\S+)`}
+	if v := title.getKey(items[1]); v != "第二章" {
+		t.Errorf("title: %v", v)
+	}
+	tags := JsonElementSelector{KeyPath: []string{"tags", "*"}}
+	if v, ok := tags.getKey(items[0]).([]string); !ok || len(v) != 2 {
+		t.Errorf("tags: %v", tags.getKey(items[0]))
+	}
+	if v := tags.getKey(items[1]); v != "" {
+		t.Errorf("empty tags: %v", v)
+	}
+}
+
+func TestXPathSelector(t *testing.T) {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(`<html><body>
+	<ul><li><a href="/a/1">标题一</a><b>发布时间</b> 2022-02-15 <span>x</span></li>
+	<li><a href="/a/2">标题二</a><b>发布时间</b> 2022-02-16 <span>y</span></li></ul>
+	</body></html>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	date := ElementSelector{XPath: `b[text()='发布时间']/following-sibling::text()[1]`}
+	link := ElementSelector{XPath: `a/@href`}
+	count := ElementSelector{XPath: `count(//li)`}
+	titles := ElementSelector{Selector: "li", XPath: `a`}
+	// the keys of an extra page as runStage parses them
+	fromDoc := func(e ElementSelector) interface{} {
+		value, _ := e.getKeys(doc.Selection, docUrl(doc), true, true)
+		return value
+	}
+	doc.Find("li").Each(func(i int, s *goquery.Selection) {
+		if v := strings.TrimSpace(date.getKey(s, "")); v != []string{"2022-02-15", "2022-02-16"}[i] {
+			t.Errorf("date %d: %q", i, v)
+		}
+		if v := link.getKey(s, ""); v != []string{"/a/1", "/a/2"}[i] {
+			t.Errorf("link %d: %q", i, v)
+		}
+	})
+	if v := fromDoc(count); v != "2" {
+		t.Errorf("count: %v", v)
+	}
+	if v, ok := fromDoc(titles).([]string); !ok || len(v) != 2 || v[1] != "标题二" {
+		t.Errorf("titles: %v", fromDoc(titles))
+	}
+}
+
+func TestTransforms(t *testing.T) {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(`<html><body>
+	<div class="post"><h1>  Hello
+	  <b>World</b> </h1><a href=" ../img/1.png ">img</a><i>2022/02/15</i><em>a, b ,c</em><p></p></div>
+	<ul class="tags"><li> go </li><li>rss</li></ul>
+	</body></html>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc.Url, _ = url.Parse("https://example.com/post/1.html")
+	title := ElementSelector{Selector: "h1", Attr: "html", Transforms: []TransformStep{{Name: "strip_tags"}, {Name: "collapse"}}}
+	image := ElementSelector{Selector: "a", Attr: "href", Transforms: []TransformStep{{Name: "resolve_url"}}}
+	date := ElementSelector{Selector: "i", Transforms: []TransformStep{{Name: "parse_date", Layout: "Y/mm/dd"}}}
+	words := ElementSelector{Selector: "em", Transforms: []TransformStep{{Name: "split", Sep: ","}, {Name: "trim"}}}
+	tags := ElementSelector{Selector: "ul.tags li", Transforms: []TransformStep{{Name: "trim"}, {Name: "join", Sep: "|"}}}
+	empty := ElementSelector{Selector: "p", Transforms: []TransformStep{{Name: "default", Value: "none"}}}
+	replace := ElementSelector{Selector: "i", Transforms: []TransformStep{{Name: "replace", Pattern: `(\d+)/(\d+)/(\d+)`, Replace: "$3.$2.$1"}}}
+	// the keys of an extra page as runStage parses them
+	fromDoc := func(e ElementSelector) interface{} {
+		value, _ := e.getKeys(doc.Selection, docUrl(doc), true, true)
+		return value
+	}
+
+	if v := fromDoc(title); v != "Hello World" {
+		t.Errorf("title: %q", v)
+	}
+	if v := fromDoc(image); v != "https://example.com/img/1.png" {
+		t.Errorf("image: %v", v)
+	}
+	if v, ok := fromDoc(date).(time.Time); !ok || v.Format("2006-01-02") != "2022-02-15" {
+		t.Errorf("date: %v", fromDoc(date))
+	}
+	if v, ok := fromDoc(words).([]string); !ok || strings.Join(v, "") != "abc" {
+		t.Errorf("words: %q", fromDoc(words))
+	}
+	if v := fromDoc(tags); v != "go|rss" {
+		t.Errorf("tags: %v", v)
+	}
+	if v := fromDoc(empty); v != "none" {
+		t.Errorf("default: %v", v)
+	}
+	if v := fromDoc(replace); v != "15.02.2022" {
+		t.Errorf("replace: %v", v)
+	}
+	if v, _ := image.getKeys(doc.Find("div.post"), "https://example.com/list/", false, false); v != "https://example.com/img/1.png" {
+		t.Errorf("toc image: %v", v)
+	}
+	if v := image.getKey(doc.Find("div.post"), "https://example.com/list/"); v != "https://example.com/img/1.png" {
+		t.Errorf("next page: %v", v)
+	}
+}
+
+func TestTocMultipleAndNamedGroups(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/list" {
+			fmt.Fprint(w, `<ul>
+<li><a href="/1">一</a><p>2022-02-15 作者：张三<b>x</b></p><i>go</i><i>rss</i></li>
+<li><a href="/2">二</a><p>2022-02-16 作者：李四</p></li>
+</ul>`)
+			return
+		}
+		fmt.Fprint(w, `<div class="info">字数：1024 状态：连载</div>`)
+	}))
+	defer server.Close()
+
+	rule := Rule{
+		TocUrl:       server.URL + "/list",
+		ItemSelector: "li",
+		KeyParseConf: map[string]ElementSelector{
+			"link": {Selector: "a", Attr: "href"},
+			"info": {Selector: "p", Attr: "element_text", Regex: `(?P<date>\d+-\d+-\d+) 作者：(?P<author>\S+)`},
+			"tags": {Selector: "i", Multiple: true},
+			"raw":  {Selector: "i", Attr: "out_html"},
+		},
+		ExtraSource:       server.URL + "{{.link}}",
+		ExtraKeyParseConf: map[string]ElementSelector{"words": {Selector: "div.info", Regex: `字数：(?P<count>\d+) 状态：(?P<state>\S+)`}},
+		TemplateConfig: ItemTemplate{
+			Title:   `{{.date}}|{{.author}}|{{.info}}|{{if isList .tags}}{{join "," .tags}}{{else}}{{.tags}}{{end}}|{{.raw}}|{{.words}}|{{.count}}|{{.state}}`,
+			Link:    "{{.link}}",
+			PubDate: "2022-02-15T00:00:00Z",
+		},
+	}
+	items, err := newTestChannel(t, rule, nil).Rule.GenerateItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	titles := map[string]string{}
+	for _, item := range items {
+		titles[item.Mk] = strings.TrimSpace(item.Title.String())
+	}
+	if titles["/1"] != "2022-02-15|张三|2022-02-15|go,rss|<i>go</i>|1024|1024|连载" {
+		t.Errorf("unexpected title: %s", titles["/1"])
+	}
+	if titles["/2"] != "2022-02-16|李四|2022-02-16|||1024|1024|连载" {
+		t.Errorf("unexpected title: %s", titles["/2"])
+	}
+}
+
+func TestCheckConf(t *testing.T) {
+	base := `[Desc]
+Title = "check"
+[Rule]
+TocUrl = "https://example.com/list"
+ItemSelector = "li"
+Key = "link"
+[Rule.KeyParseConf.link]
+Selector = "a"
+Attr = "href"
+Regex = '/(\d+)'
+[Rule.TemplateConfig]
+Title = "{{.link}}"
+Link = "{{.link}}"
+PubDate = "2022-02-15T00:00:00Z"
+`
+	dir := t.TempDir()
+	load := func(name, content string) (*ChannelConf, error) {
+		file := dir + "/" + name + ".toml"
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cconf, err := loadChanalConf(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &cconf, cconf.CheckConf(nil)
+	}
+
+	cconf, err := load("good", base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cconf.Rule.itemMatcher == nil || cconf.Rule.KeyParseConf["link"].regex == nil || cconf.Rule.KeyParseConf["link"].matcher == nil {
+		t.Errorf("selectors are not compiled: %+v", cconf.Rule.KeyParseConf["link"])
 	}
-	rule,err := loadChanalConf(u.HomeDir+"/.config/web2rss/conf/3dm.toml")
-	if err !=nil{
-		t.Fatal(err.Error())
-		return
+	cases := map[string]string{
+		"regex":     strings.Replace(base, `Regex = '/(\d+)'`, `Regex = '/(\d+'`, 1),
+		"css":       strings.Replace(base, `ItemSelector = "li"`, `ItemSelector = "li["`, 1),
+		"source":    strings.Replace(base, `Key = "link"`, `Key = "link"`+"\nExtraSource = \"{{.link\"", 1),
+		"plugin":    strings.Replace(base, `Key = "link"`, `Key = "link"`+"\nExtraSource = \"{{.link}}\"\nExtraKeyParsePlugin = \"missing.lua\"", 1),
+		"transform": base + "[[Rule.KeyParseConf.link.Transforms]]\nName = \"upper\"\n",
+		"filter":    base + "[[Rule.Filters]]\nKey = \"link\"\nOp = \"~\"\nValue = \"1\"\n",
 	}
-	item,err := rule.Rule.GenerateItem()
-	if err !=nil{
-		t.Fatal(err.Error())
-		return
+	expects := map[string]string{
+		"regex":     "[Rule.KeyParseConf.link] Regex:",
+		"css":       "[Rule] ItemSelector:",
+		"source":    "[Rule] ExtraSource:",
+		"plugin":    "[Rule] ExtraKeyParsePlugin:",
+		"transform": "[Rule.KeyParseConf.link] Transforms[0]:unknown transform: upper",
+		"filter":    "[Rule.Filters[0]] unknown op: ~",
 	}
-	t.Logf("item:%+v",item)
-}
\ No newline at end of file
+	for name, content := range cases {
+		_, err := load(name, content)
+		if err == nil || !strings.HasPrefix(err.Error(), dir+"/"+name+".toml: "+expects[name]) {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+	}
+
+	// a reload checks the channel loaded again only
+	bad, _ := load("bad", strings.Replace(cases["css"], `Title = "check"`, `Title = "bad"`, 1))
+	config := &Config{Channel: []*ChannelConf{bad, cconf}}
+	if err = config.CheckChannel(nil, "check"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if c, ok := config.Get("check"); !ok || c != cconf {
+		t.Errorf("channel not published: %v", c)
+	}
+
+	// a running rule is not compiled again
+	requested, release := make(chan bool), make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/list" {
+			fmt.Fprint(w, `<ul><li><a href="/1">item 1</a></li></ul>`)
+			return
+		}
+		requested <- true
+		<-release
+		fmt.Fprint(w, `<div>content</div>`)
+	}))
+	defer server.Close()
+	running := newTestChannel(t, Rule{
+		TocUrl:            server.URL + "/list",
+		ItemSelector:      "li",
+		KeyParseConf:      map[string]ElementSelector{"link": {Selector: "a", Attr: "href"}, "title": {Selector: "a"}},
+		ExtraSource:       server.URL + "{{.link}}",
+		ExtraKeyParseConf: map[string]ElementSelector{"content": {Selector: "div"}},
+	}, nil)
+	done := make(chan error)
+	go func() {
+		items, err := running.Rule.GenerateItem()
+		if err == nil && len(items) != 1 {
+			err = fmt.Errorf("expect 1 item, got %d", len(items))
+		}
+		done <- err
+	}()
+	<-requested
+	if err = running.CheckConf(nil); err == nil {
+		t.Error("a running rule is checked")
+	}
+	close(release)
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err = running.CheckConf(nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/list":
+			fmt.Fprint(w, `<ul><li><a href="/1">《书一》</a></li><li><a href="/2">《书二》</a></li><li><a href="/3"></a></li></ul>`)
+		case "/1", "/3":
+			fmt.Fprint(w, `<div class="content">正文</div>`)
+		case "/empty":
+			fmt.Fprint(w, `<ul></ul>`)
+		case "/2":
+			fmt.Fprint(w, `<div class="other"></div>`)
+		default:
+			http.NotFound(w, r)
+			fmt.Fprint(w, `<div class="other"></div>`)
+		}
+	}))
+	defer server.Close()
+
+	rule := Rule{
+		TocUrl:       server.URL + "/list",
+		ItemSelector: "li",
+		KeyParseConf: map[string]ElementSelector{
+			"link":  {Selector: "a", Attr: "href"},
+			"title": {Selector: "a", Regex: "《(.*)》", Transforms: []TransformStep{{Name: "replace", Pattern: "一", Replace: "1"}}},
+		},
+		ExtraSource:       server.URL + "{{.link}}",
+		ExtraKeyParseConf: map[string]ElementSelector{"content": {Selector: "div.content", Required: true}},
+	}
+	cconf := newTestChannel(t, rule, nil)
+	cconf.Rule.explain = newExplainer()
+	if _, err := cconf.Rule.GenerateItem(); err != nil {
+		t.Fatal(err)
+	}
+	x := cconf.Rule.explain
+	if len(x.tocs) != 1 || x.tocs[0].nodes != 3 {
+		t.Errorf("unexpected toc: %+v", x.tocs)
+	}
+	title := x.keys["Rule.KeyParseConf.title"]
+	if title == nil || title.nodes != 3 || title.raw != "《书一》" || title.regex != "书一" || len(title.empty) != 1 || title.empty[0] != "/3" {
+		t.Errorf("unexpected title: %+v", title)
+	}
+	content := x.keys["Rule.ExtraKeyParseConf.content"]
+	if content == nil || content.matched != 2 || content.items != 3 || len(content.empty) != 1 || content.empty[0] != "/2" {
+		t.Errorf("unexpected content: %+v", content)
+	}
+	if failures := x.failures(); len(failures) != 1 || failures[0] != "[Rule.ExtraKeyParseConf] content is empty" {
+		t.Errorf("unexpected failures: %v", failures)
+	}
+
+	// a toc matching no item fails, its required keys are never parsed
+	cconf.Rule.TocUrl = server.URL + "/empty"
+	cconf.Rule.explain = newExplainer()
+	if _, err := cconf.Rule.GenerateItem(); err != nil {
+		t.Fatal(err)
+	}
+	failures := cconf.Rule.explain.failures()
+	if len(failures) != 2 || !strings.HasSuffix(failures[0], "/empty: no item matched") || failures[1] != "[Rule.ExtraKeyParseConf] content is empty" {
+		t.Errorf("unexpected failures: %v", failures)
+	}
+
+	// the required keys of a failed extra page are empty
+	rule.ExtraSource = server.URL + "/missing{{.link}}"
+	cconf = newTestChannel(t, rule, nil)
+	cconf.Rule.explain = newExplainer()
+	if _, err := cconf.Rule.GenerateItem(); err != nil {
+		t.Fatal(err)
+	}
+	content = cconf.Rule.explain.keys["Rule.ExtraKeyParseConf.content"]
+	if content == nil || content.items != 3 || len(content.empty) != 3 {
+		t.Errorf("unexpected content: %+v", content)
+	}
+}
+
+func TestNextPage(t *testing.T) {
+	server, requestCount := newPagedServer(5)
+	defer server.Close()
+
+	cconf := newTestChannel(t, pagedRule(server.URL, 3), nil)
+	items, err := cconf.Rule.GenerateItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 6 || *requestCount != 3 {
+		t.Errorf("max pages: %d items from %d requests", len(items), *requestCount)
+	}
+
+	repository := newTestRepository(t)
+	cconf = newTestChannel(t, pagedRule(server.URL, 10), repository)
+	*requestCount = 0
+	if err = cconf.Update(); err != nil {
+		t.Fatal(err)
+	}
+	if *requestCount != 5 {
+		t.Errorf("backfill: %d requests", *requestCount)
+	}
+	*requestCount = 0
+	items, err = cconf.Rule.GenerateItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 0 || *requestCount != 1 {
+		t.Errorf("incremental: %d items from %d requests", len(items), *requestCount)
+	}
+}
+
+func TestConditionalGet(t *testing.T) {
+	notModified := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprint(w, `<ul><li><a href="/item/1">item 1</a></li></ul>`)
+	}))
+	defer server.Close()
+
+	repository := newTestRepository(t)
+	cconf := newTestChannel(t, pagedRule(server.URL, 1), repository)
+	if err := cconf.Update(); err != nil {
+		t.Fatal(err)
+	}
+	validator, err := repository.FindValidator(cconf.Desc.Title, server.URL)
+	if err != nil || validator.ETag != `"v1"` {
+		t.Fatalf("validator not stored: %+v %v", validator, err)
+	}
+	if err = cconf.Update(); err != nil {
+		t.Fatal(err)
+	}
+	if notModified != 1 {
+		t.Errorf("expect a conditional request, got %d", notModified)
+	}
+
+	// the validator of a templated toc url no longer rendered is removed, the
+	// validators of the other toc urls are kept
+	rule := pagedRule(server.URL+"/?day={{.day}}", 1)
+	rule.ExtraConfig = map[string]string{"day": "1"}
+	cconf = newTestChannel(t, rule, repository)
+	if err = cconf.Update(); err != nil {
+		t.Fatal(err)
+	}
+	cconf.Rule.ExtraConfig["day"] = "2"
+	if err = cconf.Update(); err != nil {
+		t.Fatal(err)
+	}
+	if validator, err = repository.FindValidator(cconf.Desc.Title, server.URL+"/?day=1"); err != nil || validator.ETag != "" {
+		t.Errorf("stale validator not removed: %+v %v", validator, err)
+	}
+	for _, u := range []string{server.URL + "/?day=2", server.URL} {
+		if validator, err = repository.FindValidator(cconf.Desc.Title, u); err != nil || validator.ETag != `"v1"` {
+			t.Errorf("validator of %s not kept: %+v %v", u, validator, err)
+		}
+	}
+}
+
+func TestUpdateExisting(t *testing.T) {
+	engine, err := xorm.NewEngine("sqlite3", "file::memory:?cache=shared&_test="+t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+	// table of a version without the hash column
+	if _, err = engine.Exec("CREATE TABLE item (id INTEGER PRIMARY KEY AUTOINCREMENT, mk TEXT NOT NULL, title TEXT, link TEXT, guid TEXT, category TEXT, pubDate DATETIME, description TEXT, thumb TEXT, channel TEXT, UNIQUE(mk, channel))"); err != nil {
+		t.Fatal(err)
+	}
+	repository := newRepository(engine)
+	if err = (&Config{}).Check(repository); err != nil {
+		t.Fatal(err)
+	}
+
+	title := "chapter 1"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			// the toc page never changes, the titles are on the extra pages
+			if r.Header.Get("If-None-Match") == `"toc"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"toc"`)
+			fmt.Fprint(w, `<ul><li><a href="/book/1">book 1</a></li><li><a href="/book/2">book 2</a></li></ul>`)
+			return
+		}
+		if r.URL.Path == "/book/1" {
+			fmt.Fprintf(w, `<h1>%s</h1>`, title)
+			return
+		}
+		fmt.Fprint(w, `<h1>book 2</h1>`)
+	}))
+	defer server.Close()
+	cconf := newTestChannel(t, Rule{
+		TocUrl:            server.URL + "/",
+		ItemSelector:      "li",
+		KeyParseConf:      map[string]ElementSelector{"link": {Selector: "a", Attr: "href"}},
+		ExtraSource:       server.URL + "{{.link}}",
+		ExtraKeyParseConf: map[string]ElementSelector{"title": {Selector: "h1"}},
+		UpdateExisting:    true,
+		BumpPubDate:    true,
+	}, repository)
+	if err = cconf.Update(); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := repository.FindByMk(cconf.Desc.Title, "/book/1")
+	if err != nil || stored.Hash == "" {
+		t.Fatalf("hash not stored: %+v %v", stored, err)
+	}
+	if err = cconf.Update(); err != nil {
+		t.Fatal(err)
+	}
+	unchanged, _ := repository.FindByMk(cconf.Desc.Title, "/book/1")
+	if !unchanged.PubDate.Equal(stored.PubDate) {
+		t.Errorf("unchanged item is updated: %v", unchanged.PubDate)
+	}
+
+	title = "chapter 2"
+	if err = cconf.Update(); err != nil {
+		t.Fatal(err)
+	}
+	updated, _ := repository.FindByMk(cconf.Desc.Title, "/book/1")
+	if updated.Id != stored.Id || strings.TrimSpace(updated.Title.String()) != "chapter 2" || !updated.PubDate.After(stored.PubDate) {
+		t.Errorf("item not updated: %+v", updated)
+	}
+	other, _ := repository.FindByMk(cconf.Desc.Title, "/book/2")
+	if !other.PubDate.Equal(stored.PubDate) {
+		t.Errorf("other item is updated: %+v", other)
+	}
+}
+
+func TestRobots(t *testing.T) {
+	robots := parseRobots(`
+User-agent: Googlebot
+Disallow: /
+
+User-agent: *
+Disallow: /search
+Allow: /search/about
+Disallow: /*.php$
+Crawl-delay: 2
+`, robotsAgent)
+	for path, allowed := range map[string]bool{
+		"/":                 true,
+		"/search?q=1":       false,
+		"/search/about":     true,
+		"/index.php":        false,
+		"/index.php?page=2": true,
+	} {
+		if robots.allowed(path) != allowed {
+			t.Errorf("%s: expect allowed=%v", path, allowed)
+		}
+	}
+	if robots.crawlDelay != 2*time.Second {
+		t.Errorf("crawl delay: %v", robots.crawlDelay)
+	}
+}
+
+func TestHostMaxInFlight(t *testing.T) {
+	lock := new(sync.Mutex)
+	inFlight, maxInFlight := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		lock.Unlock()
+		time.Sleep(time.Millisecond * 20)
+		lock.Lock()
+		inFlight--
+		lock.Unlock()
+		if r.URL.Path == "/" {
+			fmt.Fprint(w, "<ul>")
+			for i := 0; i < 10; i++ {
+				fmt.Fprintf(w, `<li><a href="/item/%d">item %d</a></li>`, i, i)
+			}
+			fmt.Fprint(w, "</ul>")
+		}
+	}))
+	defer server.Close()
+
+	rule := pagedRule(server.URL+"/", 1)
+	rule.ExtraSource = server.URL + "{{.link}}"
+	rule.Politeness = &PolitenessConf{MaxInFlight: 2}
+	items, err := newTestChannel(t, rule, nil).Rule.GenerateItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 10 || maxInFlight > 2 {
+		t.Errorf("%d items, max in flight %d", len(items), maxInFlight)
+	}
+}
+
+func TestHostLimits(t *testing.T) {
+	BASE_CONF = &BaseConfig{Politeness: PolitenessConf{RequestsPerSecond: 1, RespectRobots: true}}
+	r := Rule{Politeness: &PolitenessConf{RequestsPerSecond: 2}}
+	if conf := r.politeness(); conf.RequestsPerSecond != 2 || !conf.RespectRobots {
+		t.Errorf("a rule turns RespectRobots off: %+v", conf)
+	}
+	BASE_CONF = nil
+
+	h := getHostLimiter(t.Name())
+	h.apply("a", PolitenessConf{RequestsPerSecond: 2, MaxInFlight: 4})
+	h.apply("b", PolitenessConf{RequestsPerSecond: 0.5, MaxInFlight: 2})
+	if h.limiter.Limit() != 0.5 || h.maxInFlight != 2 {
+		t.Errorf("tighten: limit %v, max in flight %d", h.limiter.Limit(), h.maxInFlight)
+	}
+	h.apply("b", PolitenessConf{RequestsPerSecond: 4})
+	if h.limiter.Limit() != 2 || h.maxInFlight != 4 {
+		t.Errorf("relax: limit %v, max in flight %d", h.limiter.Limit(), h.maxInFlight)
+	}
+	forgetHostLimits("a")
+	if h.limiter.Limit() != 4 || h.maxInFlight != 0 {
+		t.Errorf("forget: limit %v, max in flight %d", h.limiter.Limit(), h.maxInFlight)
+	}
+
+	robotsCount := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			robotsCount++
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `<ul><li><a href="/item/1">item 1</a></li></ul>`)
+	}))
+	defer server.Close()
+	rule := pagedRule(server.URL+"/", 1)
+	rule.Politeness = &PolitenessConf{RespectRobots: true}
+	cconf := newTestChannel(t, rule, nil)
+	for i := 0; i < 2; i++ {
+		if items, err := cconf.Rule.GenerateItem(); err != nil || len(items) != 1 {
+			t.Fatalf("%d items: %v", len(items), err)
+		}
+	}
+	u, _ := url.Parse(server.URL)
+	h = getHostLimiter(u.Host)
+	if robotsCount != 1 || time.Until(h.robotsExpire) > robotsRetry {
+		t.Errorf("failed robots.txt: %d requests, expire in %v", robotsCount, time.Until(h.robotsExpire))
+	}
+}
+
+func TestRetry(t *testing.T) {
+	requestCount := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+		switch r.URL.Path {
+		case "/busy":
+			if requestCount < 3 {
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprint(w, `<ul><li><a href="/item/1">item 1</a></li></ul>`)
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+
+	rule := pagedRule(server.URL+"/busy", 1)
+	rule.Retry = RetryConf{Attempts: 3, Backoff: 0, MaxBackoff: 0}
+	items, err := newTestChannel(t, rule, nil).Rule.GenerateItem()
+	if err != nil || len(items) != 1 || requestCount != 3 {
+		t.Errorf("retry 503: %d items from %d requests: %v", len(items), requestCount, err)
+	}
+
+	requestCount = 0
+	rule = pagedRule(server.URL+"/forbidden", 1)
+	_, err = newTestChannel(t, rule, nil).Rule.GenerateItem()
+	if err == nil || !strings.Contains(err.Error(), "403") || requestCount != 1 {
+		t.Errorf("403 should fail without retry: %d requests: %v", requestCount, err)
+	}
+
+	for err, retry := range map[error]bool{
+		&url.Error{Op: "Get", URL: "http://a.invalid", Err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}}: true,
+		&url.Error{Op: "Get", URL: "http://a.invalid", Err: syscall.ECONNRESET}:                                 true,
+		context.DeadlineExceeded: true,
+		&url.Error{Op: "Get", URL: "a.invalid", Err: errors.New("unsupported protocol scheme")}: false,
+		permanent(errors.New("disallowed by robots.txt")):                                       false,
+		fmt.Errorf("decode json fail:%v", io.ErrShortBuffer):                                    false,
+		errNotModified: false,
+	} {
+		if rule.Retry.shouldRetry(err) != retry {
+			t.Errorf("%v: expect retry=%v", err, retry)
+		}
+	}
+}
+
+func TestDecodeBody(t *testing.T) {
+	encode := func(e encoding.Encoding, s string) []byte {
+		b, _, err := transform.Bytes(e.NewEncoder(), []byte(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	cases := []struct {
+		body        []byte
+		contentType string
+		encoding    string
+		expect      string
+	}{
+		{encode(traditionalchinese.Big5, `<meta charset="big5"><p>繁體中文</p>`), "text/html", "", "繁體中文"},
+		{encode(japanese.ShiftJIS, `<p>日本語</p>`), "text/html; charset=Shift_JIS", "", "日本語"},
+		{encode(korean.EUCKR, `<meta http-equiv="Content-Type" content="text/html; charset=euc-kr"><p>한국어</p>`), "", "", "한국어"},
+		{encode(simplifiedchinese.GB18030, `<p>简体中文</p>`), "text/html; charset=utf-8", "gb10830", "简体中文"},
+		{[]byte("\xef\xbb\xbf<p>utf-8 中文</p>"), "", "", "utf-8 中文"},
+		{[]byte("<p>没有声明</p>"), "", "", "没有声明"},
+		{[]byte(`<meta charset="iso-8859-1"><p>caf` + "\xe9</p>"), "", "", "café"},
+		{[]byte(`<meta http-equiv="Content-Type" content="text/html; charset=windows-1252"><p>caf` + "\xe9</p>"), "", "", "café"},
+	}
+	for _, c := range cases {
+		body, err := decodeBody(c.body, c.contentType, c.encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(body), c.expect) || strings.HasPrefix(string(body), "\ufeff") {
+			t.Errorf("expect %s, got %s", c.expect, body)
+		}
+	}
+
+	// a page with a charset header is decoded once
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=gbk")
+		w.Write(encode(simplifiedchinese.GBK, `<ul><li><a href="/1">简体中文</a></li></ul>`))
+	}))
+	defer server.Close()
+	items, err := newTestChannel(t, pagedRule(server.URL, 1), nil).Rule.GenerateItem()
+	if err != nil || len(items) != 1 || strings.TrimSpace(items[0].Title.String()) != "简体中文" {
+		t.Errorf("unexpected items: %+v %v", items, err)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	t.Setenv("WEB2RSS_TEST_PASSWORD", "secret")
+	session, loginCount := "", 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			if r.PostFormValue("password") != "secret" {
+				fmt.Fprint(w, "wrong password")
+				return
+			}
+			loginCount++
+			session = fmt.Sprint("s", loginCount)
+			http.SetCookie(w, &http.Cookie{Name: "sid", Value: session, Path: "/"})
+			http.Redirect(w, r, "/welcome", http.StatusFound)
+		case "/welcome":
+			fmt.Fprint(w, "welcome")
+		default:
+			if c, err := r.Cookie("sid"); err != nil || c.Value != session {
+				fmt.Fprint(w, "请先登录")
+				return
+			}
+			fmt.Fprint(w, `<ul><li><a href="/item/1">item 1</a></li></ul>`)
+		}
+	}))
+	defer server.Close()
+
+	rule := pagedRule(server.URL, 1)
+	rule.Login = &LoginConf{
+		Url:             server.URL + "/login",
+		Form:            map[string]string{"user": "test", "password": "${WEB2RSS_TEST_PASSWORD}"},
+		SuccessContains: "welcome",
+		SuccessCookie:   "sid",
+		ExpiredContains: "请先登录",
+	}
+	cconf := newTestChannel(t, rule, nil)
+	items, err := cconf.Rule.GenerateItem()
+	if err != nil || len(items) != 1 || loginCount != 1 {
+		t.Fatalf("login: %d items, %d logins: %v", len(items), loginCount, err)
+	}
+	session = "expired"
+	items, err = cconf.Rule.GenerateItem()
+	if err != nil || len(items) != 1 || loginCount != 2 {
+		t.Fatalf("relogin: %d items, %d logins: %v", len(items), loginCount, err)
+	}
+}
+
+func TestParseFeed(t *testing.T) {
+	gbk, _, _ := transform.Bytes(simplifiedchinese.GBK.NewEncoder(), []byte(`<?xml version="1.0" encoding="gb2312"?>
+<rss version="2.0" xmlns:dc="http://purl.org/dc/elements/1.1/"><channel><title>t</title>
+<item><title>标题</title><link>https://example.com/1</link><pubDate>Tue, 15 Feb 2022 08:12:00 +0800</pubDate>
+<dc:creator>作者</dc:creator><enclosure url="https://example.com/1.mp3" type="audio/mpeg"/></item>
+</channel></rss>`))
+	atom := []byte(`<feed xmlns="http://www.w3.org/2005/Atom"><entry><title>atom</title><id>tag:1</id>
+<link rel="alternate" href="https://example.com/a"/><updated>2022-02-15T08:12:00Z</updated><summary>s</summary></entry></feed>`)
+	jsonFeed := []byte(`{"version":"https://jsonfeed.org/version/1.1","items":[{"id":"j1","url":"https://example.com/j",
+"title":"json","content_text":"c","date_published":"2022-02-15T08:12:00+08:00"}]}`)
+	for _, c := range []struct {
+		body   []byte
+		expect map[string]string
+	}{
+		{gbk, map[string]string{"title": "标题", "guid": "https://example.com/1", "author": "作者",
+			"pubDate": "2022-02-15T08:12:00+08:00", "enclosure": "https://example.com/1.mp3"}},
+		{atom, map[string]string{"title": "atom", "link": "https://example.com/a", "guid": "tag:1", "description": "s"}},
+		{jsonFeed, map[string]string{"title": "json", "guid": "j1", "content": "c", "pubDate": "2022-02-15T08:12:00+08:00"}},
+	} {
+		entries, err := parseFeed(c.body, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 {
+			t.Fatalf("expect 1 entry, got %d", len(entries))
+		}
+		for k, v := range c.expect {
+			if entries[0][k] != v {
+				t.Errorf("%s: expect %q, got %q", k, v, entries[0][k])
+			}
+		}
+	}
+}
+
+func TestFeedSource(t *testing.T) {
+	var serverUrl string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/feed" {
+			fmt.Fprintf(w, `<rss><channel><item><title>第一篇</title><link>%s/article/1</link>
+<description>摘要……</description><pubDate>Tue, 15 Feb 2022 08:12:00 +0800</pubDate></item></channel></rss>`, serverUrl)
+			return
+		}
+		fmt.Fprint(w, `<html><body><div class="content"><p>全文内容</p></div></body></html>`)
+	}))
+	defer server.Close()
+	serverUrl = server.URL
+
+	cconf := newTestChannel(t, Rule{
+		SourceType:        "feed",
+		TocUrl:            server.URL + "/feed",
+		ExtraSource:       "{{.link}}",
+		ExtraKeyParseConf: map[string]ElementSelector{"full": {Selector: "div.content", Attr: "html"}},
+		TemplateConfig: ItemTemplate{Title: "{{.title}}", Link: "{{.link}}", PubDate: "{{.pubDate}}",
+			Description: "{{.full}}"},
+	}, nil)
+	items, err := cconf.Rule.GenerateItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 {
+		t.Fatalf("expect 1 item, got %d", len(items))
+	}
+	if strings.TrimSpace(items[0].Description.String()) != "<p>全文内容</p>" || items[0].PubDate.IsZero() {
+		t.Errorf("unexpected item: %+v", items[0])
+	}
+}
+
+func TestSitemapSource(t *testing.T) {
+	var serverUrl string
+	recent := time.Now().Add(-time.Hour).Format(time.RFC3339)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/sitemap.xml":
+			fmt.Fprintf(w, `<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+<sitemap><loc>%[1]s/news.xml.gz</loc><lastmod>%[2]s</lastmod></sitemap>
+<sitemap><loc>%[1]s/archive.xml</loc><lastmod>2000-01-01</lastmod></sitemap>
+</sitemapindex>`, serverUrl, recent)
+		case "/news.xml.gz":
+			zw := gzip.NewWriter(w)
+			fmt.Fprintf(zw, `<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+<url><loc>%[1]s/article/1</loc><lastmod>%[2]s</lastmod></url>
+<url><loc>%[1]s/article/2</loc><lastmod>2000-01-01</lastmod></url>
+<url><loc>%[1]s/tag/go</loc><lastmod>%[2]s</lastmod></url>
+</urlset>`, serverUrl, recent)
+			zw.Close()
+		case "/archive.xml":
+			t.Error("old sitemap should not be requested")
+		case "/list.xml":
+			w.Header().Set("ETag", `"list"`)
+			fmt.Fprintf(w, `<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+<url><loc>%[1]s/article/a</loc><lastmod>2024-01-01T10:00:00+08:00</lastmod></url>
+<url><loc>%[1]s/article/b</loc><lastmod>2024-01-01T05:00:00+00:00</lastmod></url>
+<url><loc>%[1]s/article/c</loc><lastmod>2024-01-01T03:00:00Z</lastmod></url>
+</urlset>`, serverUrl)
+		default:
+			fmt.Fprintf(w, `<html><body><h1>%s</h1></body></html>`, r.URL.Path)
+		}
+	}))
+	defer server.Close()
+	serverUrl = server.URL
+
+	cconf := newTestChannel(t, Rule{
+		SourceType:        "sitemap",
+		TocUrl:            server.URL + "/sitemap.xml",
+		Sitemap:           SitemapConf{UrlRegex: `/article/`, MaxAgeHours: 24},
+		ExtraSource:       "{{.link}}",
+		ExtraKeyParseConf: map[string]ElementSelector{"title": {Selector: "h1"}},
+		TemplateConfig:    ItemTemplate{Title: "{{.title}}", Link: "{{.link}}", PubDate: "{{.lastmod}}"},
+	}, nil)
+	if f := cconf.Rule.sitemapFilter; f == nil || f.urlRegex == nil || !f.since.IsZero() {
+		t.Errorf("sitemap filter is not compiled: %+v", f)
+	}
+	items, err := cconf.Rule.GenerateItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 {
+		t.Fatalf("expect 1 item, got %d", len(items))
+	}
+	if strings.TrimSpace(items[0].Title.String()) != "/article/1" || strings.TrimSpace(items[0].Link.String()) != server.URL+"/article/1" {
+		t.Errorf("unexpected item: %+v", items[0])
+	}
+
+	// lastmod is compared as time and the validator of a cut sitemap is not stored
+	repository := newTestRepository(t)
+	cconf = newTestChannel(t, Rule{
+		SourceType:     "sitemap",
+		TocUrl:         server.URL + "/list.xml",
+		Sitemap:        SitemapConf{MaxUrls: 2},
+		TemplateConfig: ItemTemplate{Title: "{{.link}}", Link: "{{.link}}", PubDate: "{{.lastmod}}"},
+	}, repository)
+	if err = cconf.Update(); err != nil {
+		t.Fatal(err)
+	}
+	for mk, exists := range map[string]bool{"/article/a": false, "/article/b": true, "/article/c": true} {
+		if ok, _ := repository.Exists(cconf.Desc.Title, server.URL+mk); ok != exists {
+			t.Errorf("%s: expect stored=%v", mk, exists)
+		}
+	}
+	if validator, _ := repository.FindValidator(cconf.Desc.Title, server.URL+"/list.xml"); validator.ETag != "" {
+		t.Errorf("validator of a cut sitemap is stored: %+v", validator)
+	}
+	// the stored urls do not count in MaxUrls, the cut ones come next run
+	if err = cconf.Update(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := repository.Exists(cconf.Desc.Title, server.URL+"/article/a"); !ok {
+		t.Error("the url cut is not stored by the next run")
+	}
+	if validator, _ := repository.FindValidator(cconf.Desc.Title, server.URL+"/list.xml"); validator.ETag != `"list"` {
+		t.Errorf("validator of a sitemap not cut is not stored: %+v", validator)
+	}
+}
+
+func TestPostBody(t *testing.T) {
+	var serverUrl string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("expect POST, got %s", r.Method)
+		}
+		switch r.URL.Path {
+		case "/search":
+			if r.Header.Get("Content-Type") != "application/x-www-form-urlencoded" {
+				t.Errorf("unexpected content type: %s", r.Header.Get("Content-Type"))
+			}
+			r.ParseForm()
+			if r.PostForm.Get("q") != "golang" {
+				t.Errorf("unexpected form: %v", r.PostForm)
+			}
+			if page := r.PostForm.Get("page"); page == "1" || page == "2" {
+				fmt.Fprintf(w, `<ul><li><a href="%s/detail/%s">item</a></li></ul>`, serverUrl, page)
+				return
+			}
+			fmt.Fprint(w, `<ul></ul>`)
+		case "/detail/1", "/detail/2":
+			body := map[string]string{}
+			json.NewDecoder(r.Body).Decode(&body)
+			fmt.Fprintf(w, `{"title": "%s"}`, body["link"])
+		}
+	}))
+	defer server.Close()
+	serverUrl = server.URL
+
+	cconf := newTestChannel(t, Rule{
+		TocUrl:           server.URL + "/search",
+		Method:           "post",
+		Body:             `q={{.keyword}}&page={{.page}}`,
+		ContentType:      "application/x-www-form-urlencoded",
+		ExtraConfig:      map[string]string{"keyword": "golang"},
+		ItemSelector:     "li",
+		KeyParseConf:     map[string]ElementSelector{"link": {Selector: "a", Attr: "href"}},
+		MaxPages:         5,
+		ExtraSource:      "{{.link}}",
+		ExtraMethod:      "POST",
+		ExtraBody:        `{"link": "{{.link}}"}`,
+		ExtraContentType: "application/json",
+		ExtraJsonSource: &JsonApiSource{KeyParseConf: map[string]JsonElementSelector{
+			"title": {KeyPath: []string{"title"}}}},
+		TemplateConfig: ItemTemplate{Title: "{{.title}}", Link: "{{.link}}", PubDate: "2022-02-15T00:00:00Z"},
+	}, nil)
+	items, err := cconf.Rule.GenerateItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 {
+		t.Fatalf("expect 2 items, got %d", len(items))
+	}
+	for _, item := range items {
+		if strings.TrimSpace(item.Title.String()) != strings.TrimSpace(item.Link.String()) {
+			t.Errorf("unexpected item: %+v", item)
+		}
+	}
+}
+
+func TestExpandTocUrls(t *testing.T) {
+	r := Rule{
+		TocUrl: "https://example.com/list",
+		TocUrlList: []string{
+			`{{range $i := until 3}}{{$.base}}/page/{{add $i 1}}
+{{end}}`,
+			`{{.base}}/day/{{now | dateModify "-24h" | date "2006-01-02"}}`,
+		},
+		ExtraConfig: map[string]string{"base": "https://example.com"},
+	}
+	// half an hour past midnight, the day before is in the previous month
+	now := time.Date(2024, 3, 1, 0, 30, 0, 0, time.Local)
+	urls, err := r.expandTocUrls(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"https://example.com/list",
+		"https://example.com/page/1",
+		"https://example.com/page/2",
+		"https://example.com/page/3",
+		"https://example.com/day/2024-02-29",
+	}
+	if strings.Join(urls, " ") != strings.Join(expected, " ") {
+		t.Errorf("expect %v, got %v", expected, urls)
+	}
+}
+
+func TestAutoContent(t *testing.T) {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(`<html><head>
+<meta property="og:image" content="/cover.jpg">
+<meta name="author" content="张三">
+<meta property="article:published_time" content="2022-02-15T08:12:00+08:00">
+</head><body>
+<div class="nav"><a href="/">首页</a> <a href="/news">新闻</a> <a href="/about">关于我们的网站介绍和联系方式</a></div>
+<div class="sidebar"><p>热门文章，推荐阅读，广告位招租，欢迎联系我们，谢谢。</p></div>
+<div id="article-content">
+<p>第一段正文内容，包含一些逗号，用于测试评分算法，是否能够找到正文。</p>
+<p>第二段正文内容，同样包含逗号，并且足够长，能够得到更高的分数。</p>
+<p><img src="img/1.png">第三段正文，继续补充内容，让正文的得分高于其他区域。</p>
+</div>
+<div class="comment"><p>评论：写得不错，支持一下，期待更新，作者加油。</p></div>
+</body></html>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := autoContent(doc, "https://example.com/news/1.html")
+	content := result["content"].(string)
+	if !strings.Contains(content, "第一段正文") || !strings.Contains(content, "第三段正文") {
+		t.Errorf("main content not found: %s", content)
+	}
+	if strings.Contains(content, "热门文章") || strings.Contains(content, "评论") {
+		t.Errorf("content contains sidebar or comment: %s", content)
+	}
+	if !strings.Contains(content, `src="https://example.com/news/img/1.png"`) {
+		t.Errorf("image src is not resolved: %s", content)
+	}
+	if result["image"] != "https://example.com/cover.jpg" || result["author"] != "张三" ||
+		result["published"] != "2022-02-15T08:12:00+08:00" {
+		t.Errorf("unexpected result: %v", result)
+	}
+}
+
+func TestExtraStages(t *testing.T) {
+	var serverUrl string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/list":
+			fmt.Fprint(w, `<ul><li><a href="/book/1">book</a></li></ul>`)
+		case "/book/1":
+			fmt.Fprint(w, `<h1>小说</h1><a class="down" href="/down/1">下载</a>`)
+		case "/down/1":
+			if r.Header.Get("Referer") != "book" {
+				t.Errorf("header of stage not sent: %v", r.Header)
+			}
+			fmt.Fprint(w, `<span class="size">12MB</span>`)
+		case "/json/book/1":
+			fmt.Fprint(w, `{"size": `)
+		}
+	}))
+	defer server.Close()
+	serverUrl = server.URL
+
+	cconf := newTestChannel(t, Rule{
+		TocUrl:            server.URL + "/list",
+		ItemSelector:      "li",
+		KeyParseConf:      map[string]ElementSelector{"link": {Selector: "a", Attr: "href"}},
+		ExtraSource:       serverUrl + "{{.link}}",
+		ExtraKeyParseConf: map[string]ElementSelector{"title": {Selector: "h1"}, "down": {Selector: "a.down", Attr: "href"}},
+		ExtraStages: []ExtraStage{{
+			Source:       serverUrl + "{{.down}}",
+			Headers:      map[string]string{"Referer": "book"},
+			KeyParseConf: map[string]ElementSelector{"size": {Selector: "span.size"}},
+		}},
+		TemplateConfig: ItemTemplate{Title: "{{.title}} {{.size}}", Link: "{{.link}}", PubDate: "2022-02-15T00:00:00Z"},
+	}, nil)
+	items, err := cconf.Rule.GenerateItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || strings.TrimSpace(items[0].Title.String()) != "小说 12MB" {
+		t.Errorf("unexpected items: %+v", items)
+	}
+
+	cconf = newTestChannel(t, Rule{
+		TocUrl:       server.URL + "/list",
+		ItemSelector: "li",
+		KeyParseConf: map[string]ElementSelector{"link": {Selector: "a", Attr: "href"}},
+		ExtraStages: []ExtraStage{{
+			Source:           serverUrl + "/json{{.link}}",
+			JsonKeyParseConf: map[string]JsonElementSelector{"size": {KeyPath: []string{"size"}}},
+		}},
+	}, nil)
+	items, _ = cconf.Rule.GenerateItem()
+	failures := cconf.Rule.ItemFailures()
+	if len(items) != 0 || len(failures) != 1 || !strings.Contains(failures[0].Error(), "json") {
+		t.Errorf("bad json should fail the item: %d items, failures %v", len(items), failures)
+	}
+
+	// a panicking stage fails the item only
+	cconf.Rule.stages[0].source = nil
+	items, err = cconf.Rule.GenerateItem()
+	failures = cconf.Rule.ItemFailures()
+	if err != nil || len(items) != 0 || len(failures) != 1 || !strings.Contains(failures[0].Error(), "panic") {
+		t.Errorf("a panic should fail the item: %v, %d items, failures %v", err, len(items), failures)
+	}
+}
+
+func TestExtraWorkerPool(t *testing.T) {
+	lock := new(sync.Mutex)
+	inFlight, maxInFlight := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/list" {
+			fmt.Fprint(w, "<ul>")
+			for i := 0; i < 40; i++ {
+				fmt.Fprintf(w, `<li><a href="/book/%d">book</a></li>`, i)
+			}
+			fmt.Fprint(w, "</ul>")
+			return
+		}
+		lock.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		lock.Unlock()
+		time.Sleep(time.Millisecond * 5)
+		lock.Lock()
+		inFlight--
+		lock.Unlock()
+		if strings.HasSuffix(r.URL.Path, "7") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, `<h1>%s</h1>`, r.URL.Path)
+	}))
+	defer server.Close()
+
+	cconf := newTestChannel(t, Rule{
+		TocUrl:             server.URL + "/list",
+		ItemSelector:       "li",
+		KeyParseConf:       map[string]ElementSelector{"link": {Selector: "a", Attr: "href"}},
+		ExtraSource:        server.URL + "{{.link}}",
+		ExtraKeyParseConf:  map[string]ElementSelector{"title": {Selector: "h1"}},
+		ExtraGroutineCount: 3,
+		TemplateConfig:     ItemTemplate{Title: "{{.title}}", Link: "{{.link}}", PubDate: "2022-02-15T00:00:00Z"},
+	}, nil)
+	items, err := cconf.Rule.GenerateItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 36 || len(cconf.Rule.ItemFailures()) != 4 {
+		t.Errorf("unexpected result: %d items, failures %v", len(items), cconf.Rule.ItemFailures())
+	}
+	for _, item := range items {
+		if strings.TrimSpace(item.Title.String()) != item.Mk {
+			t.Errorf("item mixed up: %s %s", item.Title.String(), item.Mk)
+		}
+	}
+	if maxInFlight > 3 {
+		t.Errorf("extra pages in flight: %d", maxInFlight)
+	}
+}
+
+func TestFilters(t *testing.T) {
+	requested := map[string]bool{}
+	lock := new(sync.Mutex)
+	recent := time.Now().Add(-time.Hour * 24).Format("2006-01-02")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/list" {
+			fmt.Fprint(w, `<ul>
+<li><a href="/1">news 1</a><span>张三</span></li>
+<li><a href="/2">广告 2</a><span>张三</span></li>
+<li><a href="/3">news 3</a><span>李四</span></li>
+<li><a href="/4">news 4</a><span>张三</span></li>
+</ul>`)
+			return
+		}
+		lock.Lock()
+		requested[r.URL.Path] = true
+		lock.Unlock()
+		date := recent
+		if r.URL.Path == "/4" {
+			date = "2001-01-01"
+		}
+		fmt.Fprintf(w, `<time>%s</time><b>共%s章</b>`, date, strings.TrimPrefix(r.URL.Path, "/"))
+	}))
+	defer server.Close()
+
+	rule := Rule{
+		TocUrl:            server.URL + "/list",
+		ItemSelector:      "li",
+		KeyParseConf:      map[string]ElementSelector{"link": {Selector: "a", Attr: "href"}, "title": {Selector: "a"}, "author": {Selector: "span"}},
+		ExtraSource:       server.URL + "{{.link}}",
+		ExtraKeyParseConf: map[string]ElementSelector{"date": {Selector: "time"}, "chapters": {Selector: "b"}},
+		Filters: []FilterConf{
+			{Action: "exclude", Key: "title", Contains: "广告"},
+			{Key: "author", Regex: "^张三$"},
+			{Key: "date", Op: ">=", Value: "-7d"},
+			{Key: "chapters", Op: ">", Value: "0"},
+		},
+	}
+	cconf := newTestChannel(t, rule, nil)
+	items, err := cconf.Rule.GenerateItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Mk != "/1" {
+		t.Errorf("unexpected items: %+v", items)
+	}
+	if requested["/2"] || requested["/3"] || !requested["/4"] {
+		t.Errorf("the toc filters are not applied before the extra pages: %v", requested)
+	}
+	drops := map[string]string{}
+	for _, drop := range cconf.Rule.FilterDrops() {
+		drops[drop.Item] = drop.Filter
+	}
+	if drops["/2"] != `exclude title contains "广告"` || drops["/3"] != `include author regex "^张三$"` || drops["/4"] != "include date >= -7d" {
+		t.Errorf("unexpected drops: %v", drops)
+	}
+
+	// the drops of the toc page are stored and not requested again, the
+	// ones after the extra pages are
+	repository := newTestRepository(t)
+	cconf = newTestChannel(t, rule, repository)
+	if err = cconf.Update(); err != nil {
+		t.Fatal(err)
+	}
+	requested = map[string]bool{}
+	if err = cconf.Update(); err != nil {
+		t.Fatal(err)
+	}
+	if len(requested) != 1 || !requested["/4"] {
+		t.Errorf("unexpected requests of dropped items: %v", requested)
+	}
+
+	// the dropped entries are known when paging stops
+	pagedServer, requestCount := newPagedServer(5)
+	defer pagedServer.Close()
+	paged := pagedRule(pagedServer.URL, 10)
+	paged.Filters = []FilterConf{{Action: "exclude", Key: "title", Regex: "-1$"}}
+	cconf = newTestChannel(t, paged, repository)
+	if err = cconf.Update(); err != nil {
+		t.Fatal(err)
+	}
+	*requestCount = 0
+	if items, err = cconf.Rule.GenerateItem(); err != nil || len(items) != 0 || *requestCount != 1 {
+		t.Errorf("paging with drops: %d items from %d requests: %v", len(items), *requestCount, err)
+	}
+
+	for _, conf := range []FilterConf{{Key: "title"}, {Key: "title", Op: "~", Value: "1"}, {Key: "date", Op: ">", Value: "yesterday"}, {Action: "keep", Key: "title", Contains: "a"}} {
+		if _, err := conf.compile(); err == nil {
+			t.Errorf("invalid filter compiled: %+v", conf)
+		}
+	}
+}
+
+func TestMediaProxy(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\nfake")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Referer") != "https://example.com" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(png)
+	}))
+	defer server.Close()
+	store, err := newMediaStore(MediaConf{Dir: t.TempDir(), BaseUrl: "http://rss.local/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	MEDIA_STORE = store
+	defer func() { MEDIA_STORE = nil }()
+	cconf := &ChannelConf{MediaProxy: mediaModeProxy, Desc: FeedDesc{Title: "media", Link: "https://example.com"}}
+
+	item := &Item{Description: newRssCdata(`<p><img alt="a" src="` + server.URL + `/a.png"></p>`), Thumb: server.URL + "/a.png"}
+	cconf.rewriteMedia(item)
+	hash := MD5Hash("media\n" + server.URL + "/a.png")
+	mediaUrl := "http://rss.local/media/" + hash
+	if item.Description.String() != `<p><img alt="a" src="`+mediaUrl+`"></p>` || item.Thumb != mediaUrl {
+		t.Fatalf("unexpected item: %s %s", item.Description.String(), item.Thumb)
+	}
+	body, meta, err := store.get(cconf, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != string(png) || meta.ContentType != "image/png" {
+		t.Errorf("unexpected media: %q %+v", body, meta)
+	}
+
+	cconf.MediaProxy = mediaModeInline
+	item = &Item{Thumb: server.URL + "/a.png"}
+	cconf.rewriteMedia(item)
+	if item.Thumb != "data:image/png;base64,iVBORw0KGgpmYWtl" {
+		t.Errorf("unexpected data uri: %s", item.Thumb)
+	}
+	if store.register("other", server.URL+"/a.png") == hash {
+		t.Error("the hash of the image is shared by the channels")
+	}
+
+	// the meta files are evicted with their bodies
+	store.conf.CacheMaxMB = 1
+	large := make([]byte, 700<<10)
+	old, recent := store.register("media", "http://a.invalid/old.png"), store.register("media", "http://a.invalid/recent.png")
+	for i, h := range []string{old, recent} {
+		if err = os.WriteFile(path.Join(store.conf.Dir, h), large, 0644); err != nil {
+			t.Fatal(err)
+		}
+		at := time.Now().Add(time.Duration(i-2) * time.Hour)
+		os.Chtimes(path.Join(store.conf.Dir, h), at, at)
+	}
+	store.evict()
+	for h, kept := range map[string]bool{old: false, old + ".json": false, recent: true, recent + ".json": true} {
+		if _, err := os.Stat(path.Join(store.conf.Dir, h)); (err == nil) != kept {
+			t.Errorf("%s: expect kept=%v", h, kept)
+		}
+	}
+}
+
+func TestProxyPool(t *testing.T) {
+	banned := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer banned.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Host != "toc.invalid" {
+			t.Errorf("request is not proxied: %s", r.URL)
+		}
+		fmt.Fprint(w, `<ul><li><a href="/a/1">第一篇</a></li></ul>`)
+	}))
+	defer healthy.Close()
+	BASE_CONF = &BaseConfig{ProxyPools: map[string][]string{t.Name(): {banned.URL, healthy.URL}}}
+	defer func() { BASE_CONF = nil }()
+
+	cconf := newTestChannel(t, Rule{
+		TocUrl:       "http://toc.invalid/list",
+		ProxyPool:    t.Name(),
+		Retry:        RetryConf{Attempts: 3},
+		ItemSelector: "li",
+		KeyParseConf: map[string]ElementSelector{"link": {Selector: "a", Attr: "href"}, "title": {Selector: "a"}},
+	}, nil)
+	items, err := cconf.Rule.GenerateItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 {
+		t.Fatalf("expect 1 item, got %d", len(items))
+	}
+	status := getProxyPool(t.Name()).status()
+	if status[0].Healthy || status[0].Failures != 1 || !status[1].Healthy || status[1].Successes != 1 {
+		t.Errorf("unexpected proxy status: %+v", status)
+	}
+}
+
+func TestRequestLimits(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/list":
+			fmt.Fprint(w, `<ul><li><a href="/fast">fast</a></li><li><a href="/hang">hang</a></li></ul>`)
+		case "/hang":
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second * 5):
+			}
+		case "/large":
+			fmt.Fprint(w, strings.Repeat("<p>large</p>", 100))
+		default:
+			fmt.Fprint(w, `<h1>fast</h1>`)
+		}
+	}))
+	defer server.Close()
+
+	rule := Rule{
+		TocUrl:            server.URL + "/list",
+		ItemSelector:      "li",
+		KeyParseConf:      map[string]ElementSelector{"link": {Selector: "a", Attr: "href"}},
+		ExtraSource:       server.URL + "{{.link}}",
+		ExtraKeyParseConf: map[string]ElementSelector{"title": {Selector: "h1"}},
+		ExtraTimeout:      1,
+		Retry:             RetryConf{Attempts: 1},
+	}
+	startAt := time.Now()
+	items, err := newTestChannel(t, rule, nil).Rule.GenerateItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || time.Since(startAt) > time.Second*3 {
+		t.Errorf("expect 1 item within the timeout, got %d in %v", len(items), time.Since(startAt))
+	}
+
+	rule.TocUrl = server.URL + "/large"
+	rule.MaxBodyBytes = 100
+	_, err = newTestChannel(t, rule, nil).Rule.GenerateItem()
+	if err == nil || !strings.Contains(err.Error(), "exceeds 100 bytes") {
+		t.Errorf("expect body limit error, got %v", err)
+	}
+
+	plugin := path.Join(t.TempDir(), "hang.lua")
+	if err = os.WriteFile(plugin, []byte("function GetContent(url)\n  while true do end\nend\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rule.TocUrl = server.URL + "/list"
+	rule.MaxBodyBytes = 0
+	rule.ExtraKeyParsePlugin = plugin
+	cconf := newTestChannel(t, rule, nil)
+	startAt = time.Now()
+	items, _ = cconf.Rule.GenerateItem()
+	if len(items) != 0 || len(cconf.Rule.ItemFailures()) != 2 || time.Since(startAt) > time.Second*3 {
+		t.Errorf("plugin should stop after ExtraTimeout: %d items, failures %v in %v", len(items), cconf.Rule.ItemFailures(), time.Since(startAt))
+	}
+}
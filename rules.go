@@ -4,7 +4,11 @@ import (
 	"bytes"
 	"context"
 	"encoding/xml"
+	"errors"
 	"fmt"
+	"io"
+	"mime"
+	"net/http"
 	"regexp"
 	"strings"
 	"sync"
@@ -14,11 +18,10 @@ import (
 	"github.com/imroc/req/v3"
 	"github.com/panjf2000/ants/v2"
 
-	"github.com/Masterminds/sprig"
 	"github.com/PuerkitoBio/goquery"
+	"github.com/antchfx/xpath"
+	luaclient "github.com/vadv/gopher-lua-libs/http/client"
 	"golang.org/x/net/html"
-	"golang.org/x/text/encoding/simplifiedchinese"
-	"golang.org/x/text/transform"
 )
 
 var (
@@ -60,8 +63,11 @@ type (
 		DBless           bool
 		DisableUpdate    bool
 		DisableImgSrcFix bool
+		MediaProxy       string
 		Desc             FeedDesc
 		Rule             Rule
+		// the config file of the channel
+		file string
 	}
 	FeedDesc struct {
 		Title       string
@@ -78,23 +84,64 @@ type (
 		client              *req.Client
 		extraClient         *req.Client
 		GroutineCount       int
+		ExtraGroutineCount  int
 		Encoding            string
 		TocUrl              string
 		TocUrlList          []string
+		Method              string
+		Body                string
+		ContentType         string
 		ItemSelector        string
+		ItemXPath           string
+		NextPageSelector    ElementSelector
+		MaxPages            int
 		ExtraSource         string
 		Headers             map[string]string
 		ExtraSourceHeaders  map[string]string
+		ExtraMethod         string
+		ExtraBody           string
+		ExtraContentType    string
 		NoProxy             bool
+		Proxy               string
+		ProxyPool           string
+		Timeout             int
+		ExtraTimeout        int
+		MaxBodyBytes        int
+		Retry               RetryConf
+		Login               *LoginConf
+		Politeness          *PolitenessConf
 		Key                 string
+		UpdateExisting      bool
+		BumpPubDate         bool
 		ExtraConfig         map[string]string
 		KeyParseConf        map[string]ElementSelector
 		ExtraKeyParseConf   map[string]ElementSelector
 		ExtraKeyParsePlugin string
+		ExtraAutoContent    bool
+		ExtraStages         []ExtraStage
+		SourceType          string
+		ItemPath            []string
+		JsonKeyParseConf    map[string]JsonElementSelector
+		ExtraJsonSource     *JsonApiSource
+		Sitemap             SitemapConf
+		Filters             []FilterConf
 		TemplateConfig      ItemTemplate
 		itemTemplate        *template.Template
+		itemFailures        []error
+		filters             []*itemFilter
+		filterDrops         []FilterDrop
+		bodyTemplate        *template.Template
+		tocTemplates        []*template.Template
+		itemMatcher         goquery.Matcher
+		itemXPath           *xpath.Expr
+		sitemapFilter       *sitemapFilter
+		compiled            bool
+		explain             *explainer
+		stages              []*extraStage
 		channel             string
 		repository          *Repository
+		validators          *validatorSet
+		session             *session
 	}
 	JsonApiSource struct {
 		Link         string
@@ -110,16 +157,59 @@ type (
 		Category    string
 	}
 	ElementSelector struct {
-		Selector string
-		Regex    string
-		Attr     string
+		Selector   string
+		XPath      string
+		Regex      string
+		Attr       string
+		Multiple   bool
+		Required   bool
+		Transforms []TransformStep
+		matcher    goquery.Matcher
+		xpathExpr  *xpath.Expr
+		regex      *regexp.Regexp
 	}
 	JsonElementSelector struct {
 		Regex   string
 		KeyPath []string
+		regex   *regexp.Regexp
+	}
+	validatorSet struct {
+		lock       sync.Mutex
+		validators map[string]*TocValidator
+		// templated is the toc urls rendered from a templated toc url by the run
+		templated map[string]bool
+	}
+	httpRequest struct {
+		client      *req.Client
+		method      string
+		url         string
+		body        string
+		contentType string
+		// conditional requests send the stored validator of url
+		conditional bool
+		timeout     time.Duration
+		headers     map[string]string
+		// login is the login request itself, which never logs in again
+		login bool
+	}
+	tocPage struct {
+		items    []*Item
+		next     string
+		allKnown bool
+		// nested sitemaps requested with the toc page
+		sources  []string
+		failures []error
+		drops    []FilterDrop
 	}
 )
 
+const (
+	defaultMaxPages           = 10
+	defaultExtraGroutineCount = 8
+)
+
+var errNotModified = fmt.Errorf("not modified")
+
 func NewElementSelector(selector, attr, regex string) ElementSelector {
 	return ElementSelector{
 		Selector: selector,
@@ -127,96 +217,228 @@ func NewElementSelector(selector, attr, regex string) ElementSelector {
 		Attr:     attr,
 	}
 }
-func (e *ElementSelector) getKey(s *goquery.Selection) string {
-	var text string
-	element := s
-	if e.Selector != "" {
-		element = s.Find(e.Selector).First()
-		if element == nil {
-			LOGGER.Error("sub element not found for ", e.Selector)
+
+// selectXPath evaluates the XPath expression against every node of s, attribute
+// and scalar results like string() or count() are wrapped as nodes with text.
+func selectXPath(s *goquery.Selection, expr string) (*goquery.Selection, error) {
+	exp, err := xpath.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("compile xpath %s fail:%v", expr, err)
+	}
+	return selectXPathExpr(s, exp), nil
+}
+
+func selectXPathExpr(s *goquery.Selection, exp *xpath.Expr) *goquery.Selection {
+	nodes := []*html.Node{}
+	for _, n := range s.Nodes {
+		switch v := exp.Evaluate(newHtmlNavigator(n)).(type) {
+		case *xpath.NodeIterator:
+			for v.MoveNext() {
+				nav := v.Current().(*htmlNavigator)
+				if nav.NodeType() == xpath.AttributeNode {
+					text := &html.Node{Type: html.TextNode, Data: nav.Value()}
+					nodes = append(nodes, &html.Node{Type: html.ElementNode, Data: nav.LocalName(),
+						FirstChild: text, LastChild: text})
+				} else {
+					nodes = append(nodes, nav.Current())
+				}
+			}
+		case string:
+			nodes = append(nodes, &html.Node{Type: html.TextNode, Data: v})
+		default:
+			nodes = append(nodes, &html.Node{Type: html.TextNode, Data: fmt.Sprint(v)})
 		}
 	}
+	return &goquery.Selection{Nodes: nodes}
+}
+
+func (e *ElementSelector) selectorDesc() string {
+	if e.XPath != "" {
+		return strings.TrimSpace(e.Selector + " " + e.XPath)
+	}
+	return e.Selector
+}
+
+// selectElements returns the elements of s matched by Selector and XPath, s is
+// returned when both are empty.
+func (e *ElementSelector) selectElements(s *goquery.Selection) (*goquery.Selection, error) {
+	element := s
+	if e.matcher != nil {
+		element = s.FindMatcher(e.matcher)
+	} else if e.Selector != "" {
+		element = s.Find(e.Selector)
+	}
+	if e.xpathExpr != nil {
+		return selectXPathExpr(element, e.xpathExpr), nil
+	}
+	if e.XPath != "" {
+		return selectXPath(element, e.XPath)
+	}
+	return element, nil
+}
+
+// exists reports whether the selector matches any element of s.
+func (e *ElementSelector) exists(s *goquery.Selection) bool {
+	element, err := e.selectElements(s)
+	return err == nil && element.Length() > 0
+}
+
+// elementText returns the content of es selected by Attr.
+func (e *ElementSelector) elementText(es *goquery.Selection) (string, bool) {
 	switch e.Attr {
 	case "html":
-		text, _ = element.Html()
+		text, _ := es.Html()
+		return text, true
+	case "out_html":
+		text, _ := goquery.OuterHtml(es)
+		return text, true
 	case "text", "":
-		text = element.Text()
-	default:
-		var isExists bool
-		text, isExists = element.Attr(e.Attr)
-		if !isExists {
-			LOGGER.Error("element and atrr not found in extra page for ", e.Selector)
-		}
-	}
-	if e.Regex != "" {
-		regexRes := regexp.MustCompile(e.Regex).FindStringSubmatch(text)
-		if len(regexRes) > 1 {
-			text = regexRes[1]
+		return es.Text(), true
+	case "element_text":
+		var buf bytes.Buffer
+		for _, n := range es.Nodes {
+			if n.Type == html.TextNode {
+				// Keep newlines and spaces, like jQuery
+				buf.WriteString(n.Data)
+			}
+			if n.FirstChild != nil {
+				for c := n.FirstChild; c != nil; c = c.NextSibling {
+					if c.Type == html.TextNode {
+						// Keep newlines and spaces, like jQuery
+						buf.WriteString(c.Data)
+					}
+				}
+			}
 		}
+		return buf.String(), true
+	default:
+		return es.Attr(e.Attr)
 	}
-	return text
 }
-func (e *ElementSelector) getKeyFromDoc(s *goquery.Document) interface{} {
+
+// extract returns the texts of the elements of s matched by the selector, only
+// the first one unless all or Multiple is set. The first group of Regex is the
+// text, the named groups are returned by name.
+func (e *ElementSelector) extract(s *goquery.Selection, all bool) ([]string, map[string][]string) {
 	res := []string{}
-	var regexP *regexp.Regexp
-	if e.Regex != "" {
-		regexP = regexp.MustCompile(e.Regex)
-	}
-	s.Find(e.Selector).Each(func(i int, es *goquery.Selection) {
-		var text string
-		switch e.Attr {
-		case "html":
-			text, _ = es.Html()
-		case "out_html":
-			text, _ = goquery.OuterHtml(es)
-		case "text", "":
-			text = es.Text()
-		case "element_text":
-			var buf bytes.Buffer
-			for _, n := range es.Nodes {
-				if n.Type == html.TextNode {
-					// Keep newlines and spaces, like jQuery
-					buf.WriteString(n.Data)
-				}
-				if n.FirstChild != nil {
-					for c := n.FirstChild; c != nil; c = c.NextSibling {
-						if c.Type == html.TextNode {
-							// Keep newlines and spaces, like jQuery
-							buf.WriteString(c.Data)
-						}
-					}
-				}
-			}
-			text = buf.String()
-		default:
-			var isExists bool
-			text, isExists = es.Attr(e.Attr)
-			if !isExists {
-				LOGGER.Error("element and atrr not found in extra page for ", e.Selector)
-				return
-			}
+	groups := map[string][]string{}
+	selection, err := e.selectElements(s)
+	if err != nil {
+		LOGGER.Error(err)
+		return res, groups
+	}
+	if !all && !e.Multiple {
+		selection = selection.First()
+	}
+	regexP := e.regex
+	if regexP == nil && e.Regex != "" {
+		if regexP, err = regexp.Compile(e.Regex); err != nil {
+			LOGGER.Errorf("compile regex of %s fail:%v", e.selectorDesc(), err)
+			return res, groups
+		}
+	}
+	selection.Each(func(i int, es *goquery.Selection) {
+		text, isExists := e.elementText(es)
+		if !isExists {
+			LOGGER.Error("element and atrr not found for ", e.selectorDesc())
+			return
 		}
 		if regexP != nil {
 			regexRes := regexP.FindStringSubmatch(text)
 			if len(regexRes) > 1 {
 				text = regexRes[1]
+				for gi, name := range regexP.SubexpNames() {
+					if name != "" {
+						groups[name] = append(groups[name], regexRes[gi])
+					}
+				}
 			} else {
 				LOGGER.Debug(text)
 			}
 		}
-		if strings.HasSuffix(e.Attr, "html") {
-			res = append(res, text)
-		} else {
-			res = append(res, EncodeStrForXml(text))
-		}
+		res = append(res, text)
 	})
-	switch len(res) {
+	return res, groups
+}
+
+// regexCapture returns the first group of Regex in text as extract does, text
+// when it does not match.
+func (e *ElementSelector) regexCapture(text string) string {
+	regexP := e.regex
+	if regexP == nil {
+		var err error
+		if regexP, err = regexp.Compile(e.Regex); err != nil {
+			return text
+		}
+	}
+	if regexRes := regexP.FindStringSubmatch(text); len(regexRes) > 1 {
+		return regexRes[1]
+	}
+	return text
+}
+
+// listValue is "" when texts is empty, the text when there is one, or the list.
+func listValue(texts []string) interface{} {
+	switch len(texts) {
 	case 0:
 		return ""
 	case 1:
-		return res[0]
+		return texts[0]
 	default:
-		return res
+		return texts
+	}
+}
+
+// getKey returns the text of the first element of s matched by the selector,
+// with the transforms applied.
+func (e *ElementSelector) getKey(s *goquery.Selection, pageUrl string) string {
+	value, _ := e.getKeys(s, pageUrl, false, false)
+	return filterValues(value)[0]
+}
+
+// getKeys returns the value of the selector in s with the transforms applied,
+// and the values of the named groups of Regex. The texts are escaped for xml
+// when encode is set and Attr is not html.
+func (e *ElementSelector) getKeys(s *goquery.Selection, pageUrl string, all, encode bool) (interface{}, map[string]interface{}) {
+	res, groups := e.extract(s, all)
+	encode = encode && !strings.HasSuffix(e.Attr, "html")
+	value := e.transform(listValue(res), pageUrl)
+	if encode {
+		value = mapTransform(value, func(text string) interface{} { return EncodeStrForXml(text) })
+	}
+	groupValues := map[string]interface{}{}
+	for name, texts := range groups {
+		groupValues[name] = listValue(texts)
+		if encode {
+			groupValues[name] = mapTransform(groupValues[name], func(text string) interface{} { return EncodeStrForXml(text) })
+		}
+	}
+	return value, groupValues
+}
+
+func docUrl(doc *goquery.Document) string {
+	if doc.Url == nil {
+		return ""
+	}
+	return doc.Url.String()
+}
+
+// parseKeys sets the keys of conf found by extract into item. The named groups
+// of the regexes set keys too, unless conf has a key of the same name.
+func parseKeys(item map[string]interface{}, conf map[string]ElementSelector,
+	extract func(e *ElementSelector) (interface{}, map[string]interface{})) {
+	values := map[string]interface{}{}
+	for k, selector := range conf {
+		value, groups := extract(&selector)
+		values[k] = value
+		for name, v := range groups {
+			if _, ok := conf[name]; !ok {
+				item[name] = v
+			}
+		}
+	}
+	for k, v := range values {
+		item[k] = v
 	}
 }
 
@@ -245,151 +467,664 @@ func (t *ItemTemplate) ToTempalte(templateName string) (*template.Template, erro
 	return generateTemplate(templateName, templateText)
 }
 
-func (r *Rule) doGet(url string, isExtraReq bool) (*req.Response, error) {
-	var request *req.Request
+func (r *Rule) getClient(isExtraReq bool) *req.Client {
 	if isExtraReq {
 		if r.extraClient == nil {
-			r.extraClient = req.NewClient()
-			if !r.NoProxy && proxyUrl != "" {
-				r.extraClient.SetProxyURL(proxyUrl)
-			}
-			if len(r.ExtraSourceHeaders) > 0 {
-				r.extraClient.SetCommonHeaders(r.ExtraSourceHeaders)
-			}
+			r.extraClient = r.newClient(r.ExtraSourceHeaders)
 		}
-		request = r.extraClient.R()
-	} else {
-		if r.client == nil {
-			r.client = req.NewClient()
-			if !r.NoProxy && proxyUrl != "" {
-				r.client.SetProxyURL(proxyUrl)
-			}
-			if len(r.Headers) > 0 {
-				r.client.SetCommonHeaders(r.Headers)
+		return r.extraClient
+	}
+	if r.client == nil {
+		r.client = r.newClient(r.Headers)
+	}
+	return r.client
+}
+
+// newClient creates a client sharing the session and proxy of the rule.
+func (r *Rule) newClient(headers map[string]string) *req.Client {
+	// the bodies are decoded by decodeBody, with Encoding and <meta charset>
+	client := req.NewClient().DisableAutoDecode()
+	if r.session != nil {
+		client.SetCookieJar(r.session.jar)
+	}
+	if pool := r.proxyPool(); pool != nil {
+		client.SetProxy(pool.proxyFunc)
+	} else if proxy := r.proxy(); proxy != "" {
+		client.SetProxyURL(proxy)
+	}
+	if len(headers) > 0 {
+		client.SetCommonHeaders(headers)
+	}
+	limitBody(client, r.maxBodyBytes())
+	if FIXTURE_STORE != nil {
+		FIXTURE_STORE.wrap(client)
+	}
+	return client
+}
+
+// doGet requests url with the retry policy of the rule.
+func (r *Rule) doGet(url string, isExtraReq bool) (*req.Response, error) {
+	return r.doRequest(http.MethodGet, url, "", isExtraReq)
+}
+
+// doRequest sends body to url with the toc or extra client, the content type
+// is ContentType or ExtraContentType.
+func (r *Rule) doRequest(method, url, body string, isExtraReq bool) (*req.Response, error) {
+	request := &httpRequest{
+		client:      r.getClient(isExtraReq),
+		method:      method,
+		url:         url,
+		body:        body,
+		contentType: r.ContentType,
+		// an unchanged toc page can still link to edited extra pages, so
+		// UpdateExisting always downloads it
+		conditional: !isExtraReq && method == http.MethodGet && !r.UpdateExisting,
+		timeout:     r.timeout(isExtraReq),
+	}
+	if isExtraReq {
+		request.contentType = r.ExtraContentType
+	}
+	return r.send(request)
+}
+
+// send runs request with the retry policy of the rule.
+func (r *Rule) send(request *httpRequest) (*req.Response, error) {
+	attempts := r.Retry.attempts()
+	relogin := r.Login != nil && r.session != nil && !request.login
+	for i := 0; ; i++ {
+		startAt := time.Now()
+		res, err := r.sendOnce(request)
+		if relogin && r.Login.isExpired(res) {
+			relogin = false
+			LOGGER.Infof("session of %s expired, login again", r.channel)
+			if loginErr := r.login(startAt); loginErr != nil {
+				return res, loginErr
 			}
+			i--
+			continue
+		}
+		banned := isProxyBan(err) && r.proxyPool() != nil
+		if i+1 >= attempts || !(banned || r.Retry.shouldRetry(err)) {
+			return res, err
+		}
+		delay := r.Retry.delay(i, err)
+		LOGGER.Debugf("请求失败，剩余重试次数（%d），%v 后重试:%v", attempts-i-1, delay, err)
+		if !r.isRunning() {
+			return res, err
+		}
+		select {
+		case <-time.After(delay):
+		case <-r.ctx.Done():
+			return res, err
 		}
-		request = r.client.R()
 	}
-	if r.isRunning() {
-		request.SetContext(r.newContext())
+}
+
+func (r *Rule) sendOnce(httpReq *httpRequest) (res *req.Response, err error) {
+	url := httpReq.url
+	request := httpReq.client.R()
+	ctx := r.newContext()
+	release, err := r.waitHost(ctx, httpReq.client, url)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	timeout := httpReq.timeout
+	if timeout <= 0 {
+		timeout = r.timeout(false)
+	}
+	if ctx == nil {
+		ctx = context.Background()
 	}
-	return request.Get(url)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ctx, report := r.withPoolProxy(ctx)
+	defer func() { report(err) }()
+	request.SetContext(ctx)
+	for k, v := range httpReq.headers {
+		request.SetHeader(k, v)
+	}
+	if httpReq.body != "" {
+		request.SetBodyString(httpReq.body)
+		if httpReq.contentType != "" {
+			request.SetContentType(httpReq.contentType)
+		}
+	}
+	conditional := httpReq.conditional && r.repository != nil && r.validators != nil
+	if conditional {
+		validator, err := r.repository.FindValidator(r.channel, url)
+		if err != nil {
+			LOGGER.Error(err)
+		}
+		if validator.ETag != "" {
+			request.SetHeader("If-None-Match", validator.ETag)
+		}
+		if validator.LastModified != "" {
+			request.SetHeader("If-Modified-Since", validator.LastModified)
+		}
+	}
+	res, err = request.Send(httpReq.method, url)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("request %s timeout after %v: %w", url, timeout, err)
+		}
+		return res, err
+	}
+	if conditional && res.StatusCode == http.StatusNotModified {
+		return res, errNotModified
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res, newHttpStatusError(url, res.Response)
+	}
+	if !conditional {
+		return res, nil
+	}
+	etag, lastModified := res.Header.Get("ETag"), res.Header.Get("Last-Modified")
+	if etag != "" || lastModified != "" {
+		r.validators.set(&TocValidator{Channel: r.channel, Url: url, ETag: etag, LastModified: lastModified})
+	}
+	return res, nil
+}
+
+func newValidatorSet() *validatorSet {
+	return &validatorSet{validators: map[string]*TocValidator{}, templated: map[string]bool{}}
+}
+
+func (v *validatorSet) template(url string) {
+	if v == nil {
+		return
+	}
+	v.lock.Lock()
+	v.templated[url] = true
+	v.lock.Unlock()
+}
+
+func (v *validatorSet) templatedUrls() []string {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	urls := make([]string, 0, len(v.templated))
+	for url := range v.templated {
+		urls = append(urls, url)
+	}
+	return urls
+}
+
+func (v *validatorSet) set(validator *TocValidator) {
+	v.lock.Lock()
+	validator.Templated = v.templated[validator.Url]
+	v.validators[validator.Url] = validator
+	v.lock.Unlock()
+}
+
+// drop forgets the validator of a toc page whose items were not all generated,
+// so the page is downloaded again by the next run.
+func (v *validatorSet) drop(urls ...string) {
+	if v == nil {
+		return
+	}
+	v.lock.Lock()
+	for _, url := range urls {
+		delete(v.validators, url)
+	}
+	v.lock.Unlock()
 }
 
-func (r *Rule) spideToc(tocUrl string) (items []*Item, err error) {
-	items = []*Item{}
-	var extraUrlTmp *template.Template
-	if r.ExtraSource != "" {
-		extraUrlTmp, err = template.New("").Funcs(sprig.TxtFuncMap()).Parse(r.ExtraSource)
+func (v *validatorSet) list() []*TocValidator {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	validators := make([]*TocValidator, 0, len(v.validators))
+	for _, validator := range v.validators {
+		validators = append(validators, validator)
+	}
+	return validators
+}
+
+func (r *Rule) extraSource() string {
+	if r.ExtraJsonSource != nil && r.ExtraJsonSource.Link != "" {
+		return r.ExtraJsonSource.Link
+	}
+	return r.ExtraSource
+}
+
+// pluginFetch returns web2rss.get of the lua plugin, requesting with client.
+func (r *Rule) pluginFetch(client *req.Client) func(url string) (string, error) {
+	return func(url string) (string, error) {
+		res, err := r.send(&httpRequest{client: client, method: http.MethodGet, url: url, timeout: r.timeout(true)})
+		if err != nil {
+			return "", err
+		}
+		body, err := r.decodeBody(res)
+		return string(body), err
+	}
+}
+
+// pluginTransport sends the requests of the http module of the lua plugin with
+// client, so they are limited, recorded and decoded as web2rss.get.
+type pluginTransport struct {
+	rule   *Rule
+	client *req.Client
+}
+
+func (t *pluginTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	body := ""
+	if request.Body != nil {
+		content, err := io.ReadAll(request.Body)
+		request.Body.Close()
 		if err != nil {
-			return nil, fmt.Errorf("generate template for extraUrl fail:%v", err)
+			return nil, err
+		}
+		body = string(content)
+	}
+	headers := map[string]string{}
+	for k := range request.Header {
+		// the user agent of the lua client is replaced by the one of the rule
+		if k == "User-Agent" && request.Header.Get(k) == luaclient.DefaultUserAgent {
+			continue
 		}
+		headers[k] = request.Header.Get(k)
 	}
-	var doc *goquery.Document
-	res, err := r.doGet(tocUrl, false)
+	res, err := t.rule.send(&httpRequest{
+		client:      t.client,
+		method:      request.Method,
+		url:         request.URL.String(),
+		body:        body,
+		contentType: request.Header.Get("Content-Type"),
+		timeout:     t.rule.timeout(true),
+		headers:     headers,
+	})
+	// the plugin reads the status code of a response
+	var statusErr *httpStatusError
+	if err != nil && !(errors.As(err, &statusErr) && res != nil && res.Response != nil) {
+		return nil, err
+	}
+	decoded, err := t.rule.decodeBody(res)
 	if err != nil {
-		return nil, fmt.Errorf("request to toc url fail:%v", err)
+		return nil, err
+	}
+	header := res.Header.Clone()
+	header.Del("Content-Length")
+	if mediaType, params, err := mime.ParseMediaType(res.GetContentType()); err == nil {
+		params["charset"] = "utf-8"
+		header.Set("Content-Type", mime.FormatMediaType(mediaType, params))
+	}
+	return &http.Response{
+		Status:        res.Status,
+		StatusCode:    res.StatusCode,
+		Proto:         res.Proto,
+		ProtoMajor:    res.ProtoMajor,
+		ProtoMinor:    res.ProtoMinor,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(decoded)),
+		ContentLength: int64(len(decoded)),
+		Request:       request,
+	}, nil
+}
+
+// decodeBody returns the utf-8 body of res, see decodeBody.
+func (r *Rule) decodeBody(res *req.Response) ([]byte, error) {
+	return decodeBody(res.Bytes(), res.GetContentType(), r.Encoding)
+}
+
+func (r *Rule) newDocument(res *req.Response) (*goquery.Document, error) {
+	body, err := r.decodeBody(res)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
+	if err == nil && res.Response != nil && res.Response.Request != nil {
+		// the base of the relative urls of the page
+		doc.Url = res.Response.Request.URL
+	}
+	return doc, err
+}
+
+func (r *Rule) newItemMap() map[string]interface{} {
+	item := map[string]interface{}{}
+	for k, v := range r.ExtraConfig {
+		item[k] = v
+	}
+	return item
+}
+
+func (r *Rule) hasNextPage() bool {
+	return r.NextPageSelector.Selector != "" || r.NextPageSelector.XPath != ""
+}
+
+// pagedBody reports whether the toc body depends on the page number, the toc
+// url is then requested again with the next page until no new item is found.
+func (r *Rule) pagedBody() bool {
+	return strings.Contains(r.Body, ".page")
+}
+
+func requestMethod(method string) string {
+	if method == "" {
+		return http.MethodGet
 	}
+	return strings.ToUpper(method)
+}
+
+func (r *Rule) compileBodyTemplate() (err error) {
+	r.bodyTemplate = nil
+	if r.Body != "" {
+		if r.bodyTemplate, err = generateTemplate("body", r.Body); err != nil {
+			return fmt.Errorf("generate template for Body fail:%v", err)
+		}
+	}
+	return nil
+}
+
+// renderBody renders the body template of a request with the keys of item,
+// page (the toc page number, from 1) and now.
+func renderBody(tmpl *template.Template, item map[string]interface{}, pageIndex int) (string, error) {
+	if tmpl == nil {
+		return "", nil
+	}
+	data := map[string]interface{}{"page": pageIndex, "now": time.Now()}
+	for k, v := range item {
+		data[k] = v
+	}
+	var body bytes.Buffer
+	if err := tmpl.Execute(&body, data); err != nil {
+		return "", fmt.Errorf("render request body fail:%v", err)
+	}
+	return body.String(), nil
+}
 
-	switch strings.ToLower(r.Encoding) {
-	case "gbk", "gb10830":
-		doc, err = goquery.NewDocumentFromReader(transform.NewReader(res.Body,
-			simplifiedchinese.GB18030.NewDecoder()))
+func (r *Rule) parseHtmlToc(tocUrl string, res *req.Response) ([]map[string]interface{}, string, error) {
+	doc, err := r.newDocument(res)
+	if err != nil {
+		return nil, "", fmt.Errorf("parse toc page to document fail:%v", err)
+	}
+	selection := doc.Selection
+	if r.itemMatcher != nil {
+		selection = selection.FindMatcher(r.itemMatcher)
+	} else if r.ItemSelector != "" || r.ItemXPath == "" {
+		selection = selection.Find(r.ItemSelector)
+	}
+	if r.itemXPath != nil {
+		selection = selectXPathExpr(selection, r.itemXPath)
+	} else if r.ItemXPath != "" {
+		selection, err = selectXPath(selection, r.ItemXPath)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	entries := []map[string]interface{}{}
+	selection.Each(func(i int, s *goquery.Selection) {
+		item := r.newItemMap()
+		parseKeys(item, r.KeyParseConf, func(e *ElementSelector) (interface{}, map[string]interface{}) {
+			return e.getKeys(s, tocUrl, false, false)
+		})
+		r.explain.record("Rule.KeyParseConf", r.KeyParseConf, s, item, fmt.Sprint(item[r.Key]))
+		entries = append(entries, item)
+	})
+	next := ""
+	if r.hasNextPage() && r.NextPageSelector.exists(doc.Selection) {
+		nextSelector := r.NextPageSelector
+		if nextSelector.Attr == "" {
+			nextSelector.Attr = "href"
+		}
+		if link := strings.TrimSpace(nextSelector.getKey(doc.Selection, tocUrl)); link != "" {
+			next = resolveUrl(tocUrl, link)
+		}
+	}
+	return entries, next, nil
+}
+
+func (r *Rule) parseJsonToc(res *req.Response) ([]map[string]interface{}, error) {
+	body, err := r.decodeBody(res)
+	if err != nil {
+		return nil, err
+	}
+	data, err := decodeJson(body)
+	if err != nil {
+		return nil, fmt.Errorf("parse toc page to json fail:%v", err)
+	}
+	entries := []map[string]interface{}{}
+	for _, node := range jsonItems(data, r.ItemPath) {
+		item := r.newItemMap()
+		for k, selector := range r.JsonKeyParseConf {
+			item[k] = selector.getKey(node)
+		}
+		entries = append(entries, item)
+	}
+	return entries, nil
+}
+
+func (r *Rule) parseFeedToc(res *req.Response) ([]map[string]interface{}, error) {
+	feedEntries, err := parseFeed(res.Bytes(), r.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]map[string]interface{}, len(feedEntries))
+	for i, feedEntry := range feedEntries {
+		item := r.newItemMap()
+		for k, v := range feedEntry {
+			item[k] = v
+		}
+		entries[i] = item
+	}
+	return entries, nil
+}
+
+func (r *Rule) spideToc(tocUrl string, pageIndex int, body string) (page *tocPage, err error) {
+	page = &tocPage{items: []*Item{}}
+	res, err := r.doRequest(requestMethod(r.Method), tocUrl, body, false)
+	if err == errNotModified {
+		LOGGER.Debugf("toc page not modified:%s", tocUrl)
+		page.allKnown = true
+		return page, nil
+	}
+	if err != nil {
+		r.explain.toc(tocUrl, 0, err)
+		return nil, fmt.Errorf("request to toc url fail:%v", err)
+	}
+	var entries []map[string]interface{}
+	switch strings.ToLower(r.SourceType) {
+	case "json":
+		entries, err = r.parseJsonToc(res)
+	case "feed":
+		entries, err = r.parseFeedToc(res)
+	case "sitemap":
+		entries, page.sources, err = r.parseSitemapToc(tocUrl, res.Bytes())
+	case "html", "":
+		entries, page.next, err = r.parseHtmlToc(tocUrl, res)
 	default:
-		doc, err = goquery.NewDocumentFromReader(res.Body)
+		err = fmt.Errorf("unknown source type: %s", r.SourceType)
 	}
 	if err != nil {
-		return nil, fmt.Errorf("parse toc page to document fail:%v", err)
+		r.explain.toc(tocUrl, 0, err)
+		r.validators.drop(append(page.sources, tocUrl)...)
+		return nil, err
 	}
+	r.explain.toc(tocUrl, len(entries)+len(page.sources), nil)
 
-	wait := new(sync.WaitGroup)
-	doc.Find(r.ItemSelector).Each(func(i int, s *goquery.Selection) {
-		wait.Add(1)
-		go func(selection *goquery.Selection) {
-			defer wait.Done()
-			item := map[string]interface{}{}
-			for k, v := range r.ExtraConfig {
-				item[k] = v
-			}
-			for k, selector := range r.KeyParseConf {
-				item[k] = selector.getKey(s)
+	knownCount := 0
+	newEntries := []map[string]interface{}{}
+	for _, entry := range entries {
+		key := fmt.Sprint(entry[r.Key])
+		isExists := false
+		if r.repository != nil {
+			var _err error
+			isExists, _err = r.repository.Exists(r.channel, key)
+			if _err != nil {
+				LOGGER.Error(_err)
+				continue
 			}
-			if r.repository != nil {
-				isExists, _err := r.repository.Exists(r.channel, fmt.Sprint(fmt.Sprint(item[r.Key])))
-				if _err != nil {
-					LOGGER.Error(_err)
-					return
-				}
-				if isExists {
-					return
+			if isExists {
+				knownCount++
+				if !r.UpdateExisting {
+					continue
 				}
+			} else if !r.UpdateExisting && r.isDropped(key) {
+				knownCount++
+				continue
 			}
-			if extraUrlTmp != nil {
-				var tpl bytes.Buffer
-				err := extraUrlTmp.Execute(&tpl, item)
-				if err != nil {
-					LOGGER.Error(err)
-				} else {
-					if len(r.ExtraKeyParsePlugin) > 0 {
-						extraItem, err := runGolangPlugin(r.ExtraKeyParsePlugin, tpl.String(), r.newContext())
-						if err != nil {
-							LOGGER.Error(err)
-							return
-						}
-						if len(extraItem) > 0 {
-							for k, v := range extraItem {
-								item[k] = v
-							}
-						}
-					} else {
-						extraRes, err := r.doGet(tpl.String(), true)
-						if err != nil {
-							LOGGER.Error(err)
-							return
-						} else {
-							var extraDoc *goquery.Document
-							switch strings.ToLower(r.Encoding) {
-							case "gbk", "gb10830":
-								extraDoc, err = goquery.NewDocumentFromReader(transform.NewReader(extraRes.Body,
-									simplifiedchinese.GB18030.NewDecoder()))
-							default:
-								extraDoc, err = goquery.NewDocumentFromReader(extraRes.Body)
-							}
-							if err != nil {
-								LOGGER.Error(err)
-							} else {
-								for k, selector := range r.ExtraKeyParseConf {
-									item[k] = selector.getKeyFromDoc(extraDoc)
-								}
-							}
-						}
-					}
-				}
+		}
+		if f := r.filterItem(entry, true); f != nil {
+			page.drops = append(page.drops, FilterDrop{Filter: f.String(), Item: key, toc: true})
+			// a dropped entry is known for the stop check of the next pages
+			if !isExists {
+				knownCount++
 			}
-			var tpl bytes.Buffer
-			_err := r.itemTemplate.Execute(&tpl, item)
-			if _err != nil {
-				LOGGER.Errorf("render rss xml fail: %s:%+v", _err.Error(), item)
-				return
+			continue
+		}
+		newEntries = append(newEntries, entry)
+	}
+	items, failures, drops := r.completeItems(newEntries, pageIndex)
+	page.items, page.failures = items, failures
+	page.drops = append(page.drops, drops...)
+	if len(page.failures) > 0 {
+		r.validators.drop(append(page.sources, tocUrl)...)
+	}
+	page.allKnown = knownCount == len(entries)
+	return
+}
+
+// spideTocPages follows the next page links of tocUrl until a page with no new
+// item is reached or MaxPages is exceeded, the pages are merged in the result.
+func (r *Rule) spideTocPages(tocUrl string) (*tocPage, error) {
+	maxPages := 1
+	if r.hasNextPage() || r.pagedBody() {
+		maxPages = r.MaxPages
+		if maxPages < 1 {
+			maxPages = defaultMaxPages
+		}
+	}
+	result := &tocPage{items: []*Item{}}
+	visited := map[string]bool{}
+	for pageIndex := 1; pageIndex <= maxPages && tocUrl != ""; pageIndex++ {
+		body, err := renderBody(r.bodyTemplate, r.newItemMap(), pageIndex)
+		if err != nil {
+			return nil, err
+		}
+		if visited[tocUrl+"\n"+body] {
+			break
+		}
+		visited[tocUrl+"\n"+body] = true
+		if !r.isRunning() {
+			return nil, fmt.Errorf("任务被取消")
+		}
+		page, err := r.spideToc(tocUrl, pageIndex, body)
+		if err != nil {
+			if pageIndex == 1 {
+				return nil, err
 			}
-			itemEntity := Item{}
-			_err = xml.Unmarshal(tpl.Bytes(), &itemEntity)
-			if _err != nil {
-				LOGGER.Errorf("decode item temp fail:%v:\n%s", _err, tpl.String())
-			} else {
-				itemEntity.Mk = fmt.Sprint(item[r.Key])
-				itemEntity.Channel = r.channel
-				items = append(items, &itemEntity)
+			LOGGER.Errorf("stop following next page of %s:%v", r.channel, err)
+			break
+		}
+		result.items = append(result.items, page.items...)
+		result.failures = append(result.failures, page.failures...)
+		result.drops = append(result.drops, page.drops...)
+		if page.allKnown {
+			LOGGER.Debugf("all items are known, stop at page %d:%s", pageIndex, tocUrl)
+			break
+		}
+		if page.next == "" && !r.hasNextPage() && r.pagedBody() {
+			// the next page is the same url with the next page number in the body
+			continue
+		}
+		tocUrl = page.next
+	}
+	return result, nil
+}
+
+// completeItems completes entries in a pool of ExtraGroutineCount workers, the
+// items are returned in the order of entries with the failures and the filter
+// drops of the others.
+func (r *Rule) completeItems(entries []map[string]interface{}, pageIndex int) ([]*Item, []error, []FilterDrop) {
+	if len(entries) == 0 {
+		return []*Item{}, nil, nil
+	}
+	results := make([]*Item, len(entries))
+	errs := make([]error, len(entries))
+	wait := new(sync.WaitGroup)
+	p, err := ants.NewPoolWithFunc(r.extraGroutineCount(), func(i interface{}) {
+		defer wait.Done()
+		index := i.(int)
+		defer func() {
+			if e := recover(); e != nil {
+				results[index], errs[index] = nil, fmt.Errorf("panic:%v", e)
 			}
-		}(s)
+		}()
+		results[index], errs[index] = r.completeItem(entries[index], pageIndex)
 	})
+	if err != nil {
+		return nil, []error{fmt.Errorf("create extra pool fail:%v", err)}, nil
+	}
+	defer p.Release()
+	for i := range entries {
+		wait.Add(1)
+		if err = p.Invoke(i); err != nil {
+			wait.Done()
+			errs[i] = err
+		}
+	}
 	wait.Wait()
-	return
+	items := []*Item{}
+	failures := []error{}
+	drops := []FilterDrop{}
+	for i, item := range results {
+		var filtered *errFiltered
+		if errors.As(errs[i], &filtered) {
+			drops = append(drops, FilterDrop{Filter: filtered.filter.String(), Item: fmt.Sprint(entries[i][r.Key])})
+			continue
+		}
+		if errs[i] == nil && item == nil {
+			errs[i] = fmt.Errorf("no item completed")
+		}
+		if errs[i] != nil {
+			failures = append(failures, fmt.Errorf("item %v fail:%v", entries[i][r.Key], errs[i]))
+			continue
+		}
+		items = append(items, item)
+	}
+	return items, failures, drops
 }
+
+// ItemFailures returns the items failed in the last GenerateItem.
+func (r *Rule) ItemFailures() []error {
+	return r.itemFailures
+}
+
+func (r *Rule) extraGroutineCount() int {
+	if r.ExtraGroutineCount > 0 {
+		return r.ExtraGroutineCount
+	}
+	return defaultExtraGroutineCount
+}
+
+// completeItem runs the extra stages of a toc entry and renders it with the
+// item template.
+func (r *Rule) completeItem(item map[string]interface{}, pageIndex int) (*Item, error) {
+	for i, stage := range r.stages {
+		if err := r.runStage(stage, item, pageIndex); err != nil {
+			for _, failed := range r.stages[i:] {
+				r.explain.fail(failed.section, failed.KeyParseConf, fmt.Sprint(item[r.Key]))
+			}
+			return nil, fmt.Errorf("extra stage %d fail:%v", i, err)
+		}
+	}
+	if f := r.filterItem(item, false); f != nil {
+		return nil, &errFiltered{filter: f}
+	}
+	var tpl bytes.Buffer
+	if err := r.itemTemplate.Execute(&tpl, item); err != nil {
+		return nil, fmt.Errorf("render rss xml fail:%v", err)
+	}
+	itemEntity := Item{}
+	if err := xml.Unmarshal(tpl.Bytes(), &itemEntity); err != nil {
+		return nil, fmt.Errorf("decode item temp fail:%v:\n%s", err, tpl.String())
+	}
+	itemEntity.Mk = fmt.Sprint(item[r.Key])
+	itemEntity.Channel = r.channel
+	itemEntity.Hash = itemEntity.contentHash()
+	return &itemEntity, nil
+}
+
 func (r *Rule) newContext() context.Context {
 	if r.isRunning() {
-		ctx, _ := context.WithCancel(r.ctx)
-		return ctx
+		return r.ctx
 	}
 	return nil
 }
@@ -417,21 +1152,80 @@ func (r *Rule) Cancel() {
 	}
 }
 
+// expandTocUrls returns TocUrl and TocUrlList, an url containing "{{" is a
+// template rendered with ExtraConfig and now, whose output is split on spaces
+// and new lines into many urls.
+func (r *Rule) expandTocUrls(now time.Time) ([]string, error) {
+	urls := []string{}
+	for i, tocUrl := range append([]string{r.TocUrl}, r.TocUrlList...) {
+		if !strings.Contains(tocUrl, "{{") {
+			urls = append(urls, tocUrl)
+			continue
+		}
+		var tmpl *template.Template
+		if i < len(r.tocTemplates) {
+			tmpl = r.tocTemplates[i]
+		}
+		if tmpl == nil {
+			var err error
+			if tmpl, err = generateTemplate(fmt.Sprintf("tocUrl%d", i), tocUrl); err != nil {
+				return nil, fmt.Errorf("generate template for toc url fail:%v", err)
+			}
+		}
+		// the sprig function now returns the same instant as .now
+		tmpl.Funcs(template.FuncMap{"now": func() time.Time { return now }})
+		data := r.newItemMap()
+		data["now"] = now
+		var tpl bytes.Buffer
+		if err := tmpl.Execute(&tpl, data); err != nil {
+			return nil, fmt.Errorf("render toc url fail:%v", err)
+		}
+		for _, url := range strings.Fields(tpl.String()) {
+			r.validators.template(url)
+			urls = append(urls, url)
+		}
+	}
+	return urls, nil
+}
+
 func (r *Rule) GenerateItem() ([]*Item, error) {
 	if r.isRunning() {
 		return nil, fmt.Errorf("任务正在运行中，请稍后再试")
 	}
+	if err := r.compile(); err != nil {
+		return nil, err
+	}
 	r.ctx, r.cancel = context.WithCancel(context.Background())
 	defer r.cancel()
-	tocSet := map[string]bool{r.TocUrl: true}
-	for _, u := range r.TocUrlList {
+	r.validators = newValidatorSet()
+	if err := r.initSession(); err != nil {
+		return nil, err
+	}
+	r.getClient(false)
+	r.explain.seed("Rule.KeyParseConf", r.KeyParseConf)
+	for _, stage := range r.stages {
+		r.explain.seed(stage.section, stage.KeyParseConf)
+	}
+	if r.Login != nil {
+		defer func() {
+			if err := r.session.jar.save(); err != nil {
+				LOGGER.Errorf("store cookie of %s fail:%v", r.channel, err)
+			}
+		}()
+	}
+	tocUrls, expandErr := r.expandTocUrls(time.Now())
+	if expandErr != nil {
+		return nil, expandErr
+	}
+	tocSet := map[string]bool{}
+	for _, u := range tocUrls {
 		tocSet[u] = true
 	}
 
 	items := []*Item{}
 	resChan := make(chan struct {
-		items []*Item
-		err   error
+		page *tocPage
+		err  error
 	})
 	wait := new(sync.WaitGroup)
 	groutineCount := r.GroutineCount
@@ -441,26 +1235,12 @@ func (r *Rule) GenerateItem() ([]*Item, error) {
 	p, _ := ants.NewPoolWithFunc(groutineCount, func(i interface{}) {
 		url := i.(string)
 		defer wait.Done()
-		var e error
-		var res []*Item
-		for i := 0; i < 5; i++ {
-			if !r.isRunning() {
-				e = fmt.Errorf("任务被取消")
-				break
-			}
-			res, e = r.spideToc(url)
-			if e == nil {
-				break
-			} else {
-				LOGGER.Debugf("请求失败，剩余重试次数（%d）:%s:%v", 4-i, url, e)
-				time.Sleep(time.Second)
-			}
-		}
+		page, e := r.spideTocPages(url)
 		LOGGER.Debugf("download complete:%s", url)
 		resChan <- struct {
-			items []*Item
-			err   error
-		}{items: res, err: e}
+			page *tocPage
+			err  error
+		}{page: page, err: e}
 	})
 	go func() {
 		defer p.Release()
@@ -475,14 +1255,24 @@ func (r *Rule) GenerateItem() ([]*Item, error) {
 		wait.Wait()
 	}()
 	err := []error{}
+	failures := []error{}
+	drops := []FilterDrop{}
 	for res := range resChan {
 		if res.err != nil {
 			err = append(err, res.err)
 		} else {
-			items = append(items, res.items...)
+			items = append(items, res.page.items...)
+			failures = append(failures, res.page.failures...)
+			drops = append(drops, res.page.drops...)
 		}
 	}
 	LOGGER.Debugf("download completed:%s", r.channel)
+	for _, failure := range failures {
+		LOGGER.Errorf("%s:%v", r.channel, failure)
+	}
+	r.itemFailures = failures
+	r.filterDrops = drops
+	LOGGER.Debugf("%d items of %s are dropped by the filters", len(drops), r.channel)
 	if len(err) > 0 {
 		return nil, fmt.Errorf("更新失败:%v", err)
 	}
@@ -506,13 +1296,25 @@ func NewChannelConf(d FeedDesc,
 }
 
 func (c *ChannelConf) CheckConf(repository *Repository) error {
+	file := c.file
+	if file == "" {
+		file = c.Desc.Title
+	}
+	// the workers of a run read the compiled rule
+	if c.Rule.isRunning() {
+		return fmt.Errorf("%s: channel is running, check it after the run", file)
+	}
 	tmpl, err := c.Rule.TemplateConfig.ToTempalte(c.Desc.Title)
 	if err != nil {
-		return err
+		return fmt.Errorf("%s: %v", file, confError("Rule.TemplateConfig", err))
 	}
 	c.Rule.itemTemplate = tmpl
 	c.Rule.channel = c.Desc.Title
 	c.Rule.repository = repository
+	c.Rule.compiled = false
+	if err = c.Rule.compile(); err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
 	return nil
 }
 
@@ -521,10 +1323,31 @@ func (c *ChannelConf) Update() error {
 	if err != nil {
 		return fmt.Errorf("update item %v", err)
 	}
-	LOGGER.Infof("update %d for %s", len(res), c.Desc.Title)
-	err = c.Rule.repository.Save(res)
+	if c.Rule.UpdateExisting {
+		inserted, updated, err := c.Rule.repository.Upsert(res, c.Rule.BumpPubDate)
+		if err != nil {
+			return fmt.Errorf("store data fail:%v", err)
+		}
+		LOGGER.Infof("update %d, modify %d for %s", inserted, updated, c.Desc.Title)
+	} else {
+		LOGGER.Infof("update %d for %s", len(res), c.Desc.Title)
+		err = c.Rule.repository.Save(res)
+		if err != nil {
+			return fmt.Errorf("store data fail:%v", err)
+		}
+	}
+	if err = c.Rule.repository.SaveDrops(c.Desc.Title, c.Rule.FilterDrops()); err != nil {
+		return fmt.Errorf("store filter drops fail:%v", err)
+	}
+	err = c.Rule.repository.SaveValidators(c.Rule.validators.list())
+	if err != nil {
+		return fmt.Errorf("store toc validator fail:%v", err)
+	}
+	// the urls of a templated toc url change over time, the pages not reached
+	// by the run keep their validators
+	err = c.Rule.repository.PruneValidators(c.Desc.Title, c.Rule.validators.templatedUrls())
 	if err != nil {
-		err = fmt.Errorf("store data fail:%v", err)
+		err = fmt.Errorf("prune toc validator fail:%v", err)
 	}
 	return err
 }
@@ -576,7 +1399,11 @@ func (c *ChannelConf) ToRss(searchKey string, pageSize, pageIndex int) ([]byte,
 	return c.RssRenderItem(items)
 }
 func (c *ChannelConf) injectHttpElementSrcAddrWithHostForItem(item *Item) {
-	if item == nil || item.Description == nil || len(item.Description.Content) < 1 {
+	if item == nil {
+		return
+	}
+	defer c.rewriteMedia(item)
+	if item.Description == nil || len(item.Description.Content) < 1 {
 		return
 	}
 	toReplace := map[string]bool{}
@@ -606,10 +1433,8 @@ func (c *ChannelConf) injectHttpElementSrcAddrWithHostForItem(item *Item) {
 }
 
 func (c *ChannelConf) injectHttpElementSrcAddrWithHost(items []Item) []Item {
-	if len(items) > 0 {
-		for _, item := range items {
-			c.injectHttpElementSrcAddrWithHostForItem(&item)
-		}
+	for i := range items {
+		c.injectHttpElementSrcAddrWithHostForItem(&items[i])
 	}
 	return items
 }
@@ -31,6 +31,16 @@ type (
 		Period     int
 		HttpProxy  string
 		LogLevel   string
+		Politeness PolitenessConf
+		Media      MediaConf
+		// default Timeout and ExtraTimeout (seconds) and MaxBodyBytes of the rules
+		Timeout      int
+		ExtraTimeout int
+		MaxBodyBytes int
+		// ProxyPools are the proxies of every pool, a channel uses a pool
+		// with Rule.ProxyPool.
+		ProxyPools          map[string][]string
+		ProxyBanStatusCodes []int
 	}
 	ChannelStatus struct {
 		Item   string    `json:"item"`
@@ -58,18 +68,23 @@ func (conf *Config) Get(channel string) (*ChannelConf, bool) {
 
 func (conf *Config) Check(repository *Repository) error {
 	conf.channelMap = map[string]*ChannelConf{}
-	ok, err := repository.engine.IsTableExist(new(Item))
-	if err != nil {
-		return err
-	}
-	if !ok {
-		err = repository.engine.CreateTables(new(Item))
+	for _, table := range []interface{}{new(Item), new(TocValidator), new(DroppedItem)} {
+		ok, err := repository.engine.IsTableExist(table)
 		if err != nil {
 			return err
 		}
-		err = repository.engine.CreateUniques(new(Item))
-		if err != nil {
-			return err
+		if !ok {
+			err = repository.engine.CreateTables(table)
+			if err != nil {
+				return err
+			}
+			err = repository.engine.CreateUniques(table)
+			if err != nil {
+				return err
+			}
+		} else if err = repository.engine.Sync2(table); err != nil {
+			// add the columns of a newer version
+			return fmt.Errorf("sync table fail:%v", err)
 		}
 	}
 	for _, c := range conf.Channel {
@@ -82,12 +97,31 @@ func (conf *Config) Check(repository *Repository) error {
 	return nil
 }
 
+// CheckChannel checks the config of channel loaded again, the channel is
+// published once it passes. The other channels are left as they are.
+func (conf *Config) CheckChannel(repository *Repository, channel string) error {
+	for _, c := range conf.Channel {
+		if c.Desc.Title != channel {
+			continue
+		}
+		if checked, ok := conf.Get(channel); ok && checked == c {
+			return nil
+		}
+		if err := c.CheckConf(repository); err != nil {
+			return err
+		}
+		conf.channelMap[channel] = c
+	}
+	return nil
+}
+
 func loadChanalConf(path string) (ChannelConf, error) {
 	cconf := ChannelConf{}
 	_, err := toml.DecodeFile(path, &cconf)
 	if err != nil {
 		return cconf, fmt.Errorf("read config fail for %s:%v", path, err)
 	}
+	cconf.file = path
 	return cconf, nil
 }
 
@@ -152,6 +186,16 @@ func (conf *BaseConfig) LoadConfig(confFile, addr, confDir, token string) {
 	if token != "" {
 		conf.Token = token
 	}
+	if conf.Media.Dir == "" {
+		conf.Media.Dir = path.Join(conf.userDir, "media")
+	}
+	if conf.Media.BaseUrl == "" {
+		host := conf.Addr
+		if strings.HasPrefix(host, ":") {
+			host = "localhost" + host
+		}
+		conf.Media.BaseUrl = "http://" + host
+	}
 	switch conf.LogLevel {
 	case "DEBUG", "debug", "D", "d":
 		LOGGER.SetLevel(logrus.DebugLevel)
@@ -208,8 +252,16 @@ func (svc *Service) scheduleDaemon() {
 
 func (svc *Service) Reload(channelList string) error {
 	for _, channelName := range strings.Split(channelList, ",") {
+		forgetHostLimits(channelName)
 		svc.channel.LoadConfig(BASE_CONF.ConfigDir, channelName)
-		if err := svc.channel.Check(svc.repository); err != nil {
+		// the channels loaded again are new values, a running one keeps its rule
+		var err error
+		if channelName == "" {
+			err = svc.channel.Check(svc.repository)
+		} else {
+			err = svc.channel.CheckChannel(svc.repository, channelName)
+		}
+		if err != nil {
 			return err
 		}
 		svc.repository.ClearCache(channelName)
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/imroc/req/v3"
+)
+
+type (
+	// LoginConf logs in before crawling a channel, values like ${NAME} in Url,
+	// Headers, Form, Json and Body are read from the environment.
+	LoginConf struct {
+		Url                string
+		Method             string
+		Headers            map[string]string
+		Form               map[string]string
+		Json               map[string]interface{}
+		Body               string
+		ContentType        string
+		SuccessContains    string
+		SuccessCookie      string
+		ExpiredContains    string
+		ExpiredUrl         string
+		ExpiredStatusCodes []int
+	}
+	// persistentJar is a cookie jar keeping every cookie it receives, so the
+	// session can be stored in the data dir and restored on restart.
+	persistentJar struct {
+		*cookiejar.Jar
+		lock    sync.Mutex
+		file    string
+		cookies map[string][]*http.Cookie
+	}
+	session struct {
+		lock     sync.Mutex
+		jar      *persistentJar
+		loggedAt time.Time
+	}
+)
+
+func newPersistentJar(file string) *persistentJar {
+	jar, _ := cookiejar.New(nil)
+	j := &persistentJar{Jar: jar, file: file, cookies: map[string][]*http.Cookie{}}
+	if file == "" {
+		return j
+	}
+	content, err := os.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			LOGGER.Errorf("read cookie file %s fail:%v", file, err)
+		}
+		return j
+	}
+	stored := map[string][]*http.Cookie{}
+	if err = json.Unmarshal(content, &stored); err != nil {
+		LOGGER.Errorf("decode cookie file %s fail:%v", file, err)
+		return j
+	}
+	for rawUrl, cookies := range stored {
+		if u, err := url.Parse(rawUrl); err == nil {
+			j.SetCookies(u, cookies)
+		}
+	}
+	return j
+}
+
+func (j *persistentJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.Jar.SetCookies(u, cookies)
+	key := u.Scheme + "://" + u.Host + "/"
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	stored := j.cookies[key]
+	for _, c := range cookies {
+		replaced := false
+		for i, s := range stored {
+			if s.Name == c.Name && s.Path == c.Path && s.Domain == c.Domain {
+				stored[i] = c
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			stored = append(stored, c)
+		}
+	}
+	j.cookies[key] = stored
+}
+
+func (j *persistentJar) empty() bool {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return len(j.cookies) == 0
+}
+
+func (j *persistentJar) save() error {
+	if j.file == "" {
+		return nil
+	}
+	j.lock.Lock()
+	content, err := json.Marshal(j.cookies)
+	j.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(path.Dir(j.file), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(j.file, content, 0600)
+}
+
+func cookieFile(channel string) string {
+	if BASE_CONF == nil || BASE_CONF.userDir == "" || channel == "" {
+		return ""
+	}
+	return path.Join(BASE_CONF.userDir, "cookies", url.PathEscape(channel)+".json")
+}
+
+// initSession creates the cookie jar shared by the toc and extra clients and
+// logs in when no session is stored.
+func (r *Rule) initSession() error {
+	if r.session == nil {
+		r.session = &session{jar: newPersistentJar(cookieFile(r.channel))}
+		// the clients of the stages are created when the rule is compiled
+		for _, stage := range r.stages {
+			stage.client.SetCookieJar(r.session.jar)
+		}
+	}
+	if r.Login != nil && r.session.jar.empty() {
+		return r.login(time.Time{})
+	}
+	return nil
+}
+
+// login runs the login request unless another request has logged in after since.
+func (r *Rule) login(since time.Time) error {
+	s := r.session
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.loggedAt.After(since) {
+		return nil
+	}
+	conf := r.Login
+	request := &httpRequest{
+		client:      r.getClient(false),
+		method:      strings.ToUpper(conf.Method),
+		url:         os.ExpandEnv(conf.Url),
+		contentType: conf.ContentType,
+		timeout:     r.timeout(false),
+		headers:     map[string]string{},
+		login:       true,
+	}
+	if request.method == "" {
+		request.method = http.MethodPost
+	}
+	for k, v := range conf.Headers {
+		request.headers[k] = os.ExpandEnv(v)
+	}
+	switch {
+	case len(conf.Form) > 0:
+		form := url.Values{}
+		for k, v := range conf.Form {
+			form.Set(k, os.ExpandEnv(v))
+		}
+		request.body = form.Encode()
+		if request.contentType == "" {
+			request.contentType = "application/x-www-form-urlencoded"
+		}
+	case len(conf.Json) > 0:
+		body, err := json.Marshal(expandEnvValue(conf.Json))
+		if err != nil {
+			return fmt.Errorf("login %s fail:%v", r.channel, err)
+		}
+		request.body = string(body)
+		if request.contentType == "" {
+			request.contentType = "application/json; charset=utf-8"
+		}
+	case conf.Body != "":
+		request.body = os.ExpandEnv(conf.Body)
+	}
+	res, err := r.send(request)
+	if err != nil {
+		return fmt.Errorf("login %s fail:%v", r.channel, err)
+	}
+	var cookies []*http.Cookie
+	if loginUrl, err := url.Parse(request.url); err == nil {
+		cookies = s.jar.Cookies(loginUrl)
+	}
+	if err = conf.checkSuccess(res, cookies); err != nil {
+		return fmt.Errorf("login %s fail:%v", r.channel, err)
+	}
+	s.loggedAt = time.Now()
+	LOGGER.Infof("login success: %s", r.channel)
+	if err = s.jar.save(); err != nil {
+		LOGGER.Errorf("store cookie of %s fail:%v", r.channel, err)
+	}
+	return nil
+}
+
+func expandEnvValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case string:
+		return os.ExpandEnv(value)
+	case map[string]interface{}:
+		expanded := map[string]interface{}{}
+		for k, item := range value {
+			expanded[k] = expandEnvValue(item)
+		}
+		return expanded
+	case []interface{}:
+		expanded := make([]interface{}, len(value))
+		for i, item := range value {
+			expanded[i] = expandEnvValue(item)
+		}
+		return expanded
+	default:
+		return v
+	}
+}
+
+// checkSuccess checks the final response of the login and the cookies of the
+// jar for the login url, which include the ones set by the redirects.
+func (conf *LoginConf) checkSuccess(res *req.Response, cookies []*http.Cookie) error {
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return newHttpStatusError(res.Request.RawURL, res.Response)
+	}
+	if conf.SuccessContains != "" && !strings.Contains(responseText(res), conf.SuccessContains) {
+		return fmt.Errorf("response does not contain %q", conf.SuccessContains)
+	}
+	if conf.SuccessCookie != "" {
+		for _, c := range cookies {
+			if c.Name == conf.SuccessCookie {
+				return nil
+			}
+		}
+		return fmt.Errorf("cookie %s is not set", conf.SuccessCookie)
+	}
+	return nil
+}
+
+// isExpired reports whether res shows the session has expired.
+func (conf *LoginConf) isExpired(res *req.Response) bool {
+	if res == nil || res.Response == nil {
+		return false
+	}
+	for _, code := range conf.ExpiredStatusCodes {
+		if res.StatusCode == code {
+			return true
+		}
+	}
+	if conf.ExpiredUrl != "" && res.Response.Request != nil &&
+		strings.Contains(res.Response.Request.URL.String(), conf.ExpiredUrl) {
+		return true
+	}
+	return conf.ExpiredContains != "" && strings.Contains(responseText(res), conf.ExpiredContains)
+}
+
+// responseText is the utf-8 body of res, or the raw body when the charset is
+// unknown.
+func responseText(res *req.Response) string {
+	body, err := decodeBody(res.Bytes(), res.GetContentType(), "")
+	if err != nil {
+		return res.String()
+	}
+	return string(body)
+}
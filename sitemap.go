@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSitemapDepth   = 3
+	defaultSitemapMaxUrls = 200
+)
+
+type (
+	// SitemapConf filters the urls of a sitemap source. UrlRegex and
+	// SitemapRegex select the page and nested sitemap urls, MaxAgeHours drops
+	// the entries whose lastmod is older.
+	SitemapConf struct {
+		UrlRegex     string
+		SitemapRegex string
+		MaxAgeHours  int
+		MaxDepth     int
+		MaxUrls      int
+	}
+	sitemapDoc struct {
+		XMLName  xml.Name
+		Urls     []sitemapUrl `xml:"url"`
+		Sitemaps []sitemapUrl `xml:"sitemap"`
+	}
+	sitemapUrl struct {
+		Loc       string `xml:"loc"`
+		Lastmod   string `xml:"lastmod"`
+		NewsTitle string `xml:"http://www.google.com/schemas/sitemap-news/0.9 news>title"`
+		NewsDate  string `xml:"http://www.google.com/schemas/sitemap-news/0.9 news>publication_date"`
+		Image     string `xml:"http://www.google.com/schemas/sitemap-image/1.1 image>loc"`
+	}
+	sitemapFilter struct {
+		urlRegex     *regexp.Regexp
+		sitemapRegex *regexp.Regexp
+		since        time.Time
+	}
+)
+
+// filter compiles the regexes of c, since is set by each run.
+func (c *SitemapConf) filter() (*sitemapFilter, error) {
+	f := &sitemapFilter{}
+	var err error
+	if c.UrlRegex != "" {
+		if f.urlRegex, err = regexp.Compile(c.UrlRegex); err != nil {
+			return nil, fmt.Errorf("compile Sitemap.UrlRegex fail:%v", err)
+		}
+	}
+	if c.SitemapRegex != "" {
+		if f.sitemapRegex, err = regexp.Compile(c.SitemapRegex); err != nil {
+			return nil, fmt.Errorf("compile Sitemap.SitemapRegex fail:%v", err)
+		}
+	}
+	return f, nil
+}
+
+// isOld reports whether lastmod is out of the window, an entry without
+// lastmod is always kept.
+func (f *sitemapFilter) isOld(lastmod string) bool {
+	if f.since.IsZero() || lastmod == "" {
+		return false
+	}
+	t, err := time.Parse(time.RFC3339, normalizeFeedDate(lastmod))
+	return err == nil && t.Before(f.since)
+}
+
+// parseSitemap reads an urlset or a sitemapindex, gzip compressed files are
+// supported.
+func parseSitemap(body []byte, encodingName string) (*sitemapDoc, error) {
+	if len(body) > 2 && body[0] == 0x1f && body[1] == 0x8b {
+		reader, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("read gzip sitemap fail:%v", err)
+		}
+		body, err = io.ReadAll(reader)
+		if err != nil {
+			return nil, fmt.Errorf("read gzip sitemap fail:%v", err)
+		}
+	}
+	decoder, err := newXmlDecoder(body, encodingName)
+	if err != nil {
+		return nil, err
+	}
+	doc := &sitemapDoc{}
+	if err = decoder.Decode(doc); err != nil {
+		return nil, fmt.Errorf("parse sitemap fail:%v", err)
+	}
+	return doc, nil
+}
+
+// parseSitemapToc returns an entry with the keys link, lastmod, title, pubDate
+// and image for every url of the sitemap and its nested sitemaps, the urls of
+// the nested sitemaps requested are returned too.
+func (r *Rule) parseSitemapToc(tocUrl string, body []byte) ([]map[string]interface{}, []string, error) {
+	filter := *r.sitemapFilter
+	if r.Sitemap.MaxAgeHours > 0 {
+		filter.since = time.Now().Add(-time.Duration(r.Sitemap.MaxAgeHours) * time.Hour)
+	}
+	maxDepth := r.Sitemap.MaxDepth
+	if maxDepth < 1 {
+		maxDepth = defaultSitemapDepth
+	}
+	urls := []sitemapUrl{}
+	children := []string{}
+	visited := map[string]bool{tocUrl: true}
+	var walk func(sitemapUrl string, body []byte, depth int) error
+	walk = func(sitemapUrl string, body []byte, depth int) error {
+		doc, err := parseSitemap(body, r.Encoding)
+		if err != nil {
+			return fmt.Errorf("%s:%v", sitemapUrl, err)
+		}
+		for _, u := range doc.Urls {
+			u.Loc = strings.TrimSpace(u.Loc)
+			if u.Loc == "" || filter.isOld(u.Lastmod) {
+				continue
+			}
+			if filter.urlRegex != nil && !filter.urlRegex.MatchString(u.Loc) {
+				continue
+			}
+			urls = append(urls, u)
+		}
+		for _, s := range doc.Sitemaps {
+			child := resolveUrl(sitemapUrl, strings.TrimSpace(s.Loc))
+			if visited[child] || filter.isOld(s.Lastmod) {
+				continue
+			}
+			if filter.sitemapRegex != nil && !filter.sitemapRegex.MatchString(child) {
+				continue
+			}
+			visited[child] = true
+			if depth >= maxDepth {
+				LOGGER.Debugf("skip nested sitemap beyond max depth:%s", child)
+				continue
+			}
+			res, err := r.doGet(child, false)
+			if err == errNotModified {
+				LOGGER.Debugf("sitemap not modified:%s", child)
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("request to sitemap fail:%v", err)
+			}
+			children = append(children, child)
+			if err = walk(child, res.Bytes(), depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(tocUrl, body, 1); err != nil {
+		return nil, children, err
+	}
+
+	// newest urls first, so MaxUrls keeps the latest entries
+	lastmods := make(map[string]time.Time, len(urls))
+	for _, u := range urls {
+		lastmods[u.Lastmod], _ = time.Parse(time.RFC3339, normalizeFeedDate(u.Lastmod))
+	}
+	sort.SliceStable(urls, func(i, j int) bool {
+		return lastmods[urls[i].Lastmod].After(lastmods[urls[j].Lastmod])
+	})
+	maxUrls := r.Sitemap.MaxUrls
+	if maxUrls < 1 {
+		maxUrls = defaultSitemapMaxUrls
+	}
+	entries := []map[string]interface{}{}
+	unknown, isCut := 0, false
+	for _, u := range urls {
+		item := r.newItemMap()
+		item["link"] = u.Loc
+		item["lastmod"] = normalizeFeedDate(u.Lastmod)
+		item["title"] = strings.TrimSpace(u.NewsTitle)
+		item["pubDate"] = normalizeFeedDate(firstNotEmpty(u.NewsDate, u.Lastmod))
+		item["image"] = strings.TrimSpace(u.Image)
+		// MaxUrls counts the urls not stored yet
+		if r.repository != nil && !r.UpdateExisting {
+			if isExists, err := r.repository.Exists(r.channel, fmt.Sprint(item[r.Key])); err == nil && isExists {
+				entries = append(entries, item)
+				continue
+			}
+		}
+		if unknown >= maxUrls {
+			isCut = true
+			continue
+		}
+		unknown++
+		entries = append(entries, item)
+	}
+	if isCut {
+		// the urls cut are requested again by the next run
+		r.validators.drop(append(children, tocUrl)...)
+	}
+	return entries, children, nil
+}
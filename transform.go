@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// TransformStep is a step of ElementSelector.Transforms, Name is one of trim,
+// collapse, replace, strip_tags, resolve_url, parse_date, split, join and
+// default.
+//
+// replace replaces the matches of Pattern with Replace, parse_date parses the
+// value with Layout (a go layout or the layout of timeFromStr), split and join
+// use Sep, default sets Value when the value is empty.
+type TransformStep struct {
+	Name    string
+	Pattern string
+	Replace string
+	Layout  string
+	Sep     string
+	Value   string
+	pattern *regexp.Regexp
+}
+
+var collapse_space_pattern = regexp.MustCompile(`\s+`)
+
+// transform runs the steps on value, a string or a list of strings. The string
+// steps are applied to every element of a list, pageUrl is the base of
+// resolve_url.
+func (e *ElementSelector) transform(value interface{}, pageUrl string) interface{} {
+	for _, step := range e.Transforms {
+		var err error
+		value, err = step.apply(value, pageUrl)
+		if err != nil {
+			LOGGER.Errorf("transform %s of %s fail:%v", step.Name, e.selectorDesc(), err)
+		}
+	}
+	return value
+}
+
+// compile checks the name of the step and compiles its pattern.
+func (t *TransformStep) compile() error {
+	switch t.Name {
+	case "split", "join", "default":
+		return nil
+	case "replace":
+		pattern, err := regexp.Compile(t.Pattern)
+		if err != nil {
+			return fmt.Errorf("compile pattern fail:%v", err)
+		}
+		t.pattern = pattern
+		return nil
+	}
+	_, err := t.stringFunc("")
+	return err
+}
+
+func (t *TransformStep) apply(value interface{}, pageUrl string) (interface{}, error) {
+	switch t.Name {
+	case "split":
+		return mapTransform(value, func(s string) interface{} {
+			if s == "" {
+				return []string{}
+			}
+			return strings.Split(s, t.Sep)
+		}), nil
+	case "join":
+		if list, ok := value.([]string); ok {
+			return strings.Join(list, t.Sep), nil
+		}
+		return value, nil
+	case "default":
+		if isEmptyValue(value) {
+			return t.Value, nil
+		}
+		return value, nil
+	}
+	fn, err := t.stringFunc(pageUrl)
+	if err != nil {
+		return value, err
+	}
+	return mapTransform(value, fn), nil
+}
+
+func (t *TransformStep) stringFunc(pageUrl string) (func(string) interface{}, error) {
+	switch t.Name {
+	case "trim":
+		return func(s string) interface{} { return strings.TrimSpace(s) }, nil
+	case "collapse":
+		return func(s string) interface{} {
+			return strings.TrimSpace(collapse_space_pattern.ReplaceAllString(s, " "))
+		}, nil
+	case "replace":
+		pattern := t.pattern
+		if pattern == nil {
+			var err error
+			if pattern, err = regexp.Compile(t.Pattern); err != nil {
+				return nil, fmt.Errorf("compile pattern fail:%v", err)
+			}
+		}
+		return func(s string) interface{} { return pattern.ReplaceAllString(s, t.Replace) }, nil
+	case "strip_tags":
+		return func(s string) interface{} {
+			doc, err := goquery.NewDocumentFromReader(strings.NewReader(s))
+			if err != nil {
+				return s
+			}
+			return doc.Text()
+		}, nil
+	case "resolve_url":
+		return func(s string) interface{} {
+			if s == "" || pageUrl == "" {
+				return s
+			}
+			return resolveUrl(pageUrl, strings.TrimSpace(s))
+		}, nil
+	case "parse_date":
+		layout := t.Layout
+		if !strings.Contains(layout, "2006") {
+			layout = tmpGenerateTimeFormat(layout)
+		}
+		return func(s string) interface{} {
+			date, err := time.ParseInLocation(layout, strings.TrimSpace(s), time.Local)
+			if err != nil {
+				LOGGER.Debugf("parse date %s with %s fail:%v", s, layout, err)
+				return s
+			}
+			return date
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown transform: %s", t.Name)
+	}
+}
+
+// mapTransform applies fn to a string or to every string of a list, the values
+// of other types are kept.
+func mapTransform(value interface{}, fn func(string) interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return fn(v)
+	case []string:
+		strs := []string{}
+		values := []interface{}{}
+		dates := false
+		for _, e := range v {
+			switch r := fn(e).(type) {
+			case string:
+				strs = append(strs, r)
+				values = append(values, r)
+			case []string:
+				strs = append(strs, r...)
+				for _, rs := range r {
+					values = append(values, rs)
+				}
+			default:
+				dates = true
+				values = append(values, r)
+			}
+		}
+		if dates {
+			return values
+		}
+		return strs
+	case []interface{}:
+		values := make([]interface{}, len(v))
+		for i, e := range v {
+			values[i] = e
+			if str, ok := e.(string); ok {
+				values[i] = fn(str)
+			}
+		}
+		return values
+	default:
+		return value
+	}
+}
+
+func isEmptyValue(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case string:
+		return strings.TrimSpace(v) == ""
+	case []string:
+		return len(v) == 0
+	case []interface{}:
+		return len(v) == 0
+	case time.Time:
+		return v.IsZero()
+	default:
+		return false
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/url"
 	"reflect"
 	"regexp"
 	"strconv"
@@ -15,6 +17,8 @@ import (
 
 	"github.com/Masterminds/sprig"
 	libs "github.com/vadv/gopher-lua-libs"
+	luahttp "github.com/vadv/gopher-lua-libs/http"
+	luaclient "github.com/vadv/gopher-lua-libs/http/client"
 	lua "github.com/yuin/gopher-lua"
 	query "github.com/zhnxin/glua-query"
 )
@@ -136,7 +140,65 @@ func generateTemplate(tempName, tempContext string) (*template.Template, error)
 	}).Parse(tempContext)
 }
 
-func runGolangPlugin(pluginPath,addr string,ctx context.Context)(map[string]interface{},error){
+// preloadWeb2rss registers the web2rss module for plugins:
+// web2rss.get(url) returns the utf-8 body fetched by the rule, and
+// web2rss.decode(body, content_type, encoding) converts a body to utf-8.
+func preloadWeb2rss(L *lua.LState, fetch func(url string) (string, error)) {
+	L.PreloadModule("web2rss", func(L *lua.LState) int {
+		mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+			"get": func(L *lua.LState) int {
+				body, err := fetch(L.CheckString(1))
+				if err != nil {
+					L.Push(lua.LNil)
+					L.Push(lua.LString(err.Error()))
+					return 2
+				}
+				L.Push(lua.LString(body))
+				L.Push(lua.LNil)
+				return 2
+			},
+			"decode": func(L *lua.LState) int {
+				body, err := decodeBody([]byte(L.CheckString(1)), L.OptString(2, ""), L.OptString(3, ""))
+				if err != nil {
+					L.Push(lua.LNil)
+					L.Push(lua.LString(err.Error()))
+					return 2
+				}
+				L.Push(lua.LString(body))
+				L.Push(lua.LNil)
+				return 2
+			},
+		})
+		L.Push(mod)
+		return 1
+	})
+}
+
+// preloadHttp replaces the transport of the clients created by the http and
+// http_client modules with transport.
+func preloadHttp(L *lua.LState, transport http.RoundTripper) {
+	newClient := func(L *lua.LState) int {
+		n := luaclient.New(L)
+		if ud, ok := L.Get(-1).(*lua.LUserData); ok {
+			if client, ok := ud.Value.(*luaclient.LuaClient); ok {
+				client.Transport = transport
+			}
+		}
+		return n
+	}
+	for name, loader := range map[string]lua.LGFunction{"http": luahttp.Loader, "http_client": luaclient.Loader} {
+		loader := loader
+		L.PreloadModule(name, func(L *lua.LState) int {
+			n := loader(L)
+			if mod, ok := L.Get(-1).(*lua.LTable); ok {
+				L.SetField(mod, "client", L.NewFunction(newClient))
+			}
+			return n
+		})
+	}
+}
+
+func runGolangPlugin(pluginPath,addr string,ctx context.Context,fetch func(url string) (string, error),transport http.RoundTripper)(map[string]interface{},error){
 	L := lua.NewState()
 	if ctx != nil {
 		L.SetContext(ctx)
@@ -144,6 +206,10 @@ func runGolangPlugin(pluginPath,addr string,ctx context.Context)(map[string]inte
 	defer L.Close()
 	libs.Preload(L)
 	query.Preload(L)
+	preloadWeb2rss(L, fetch)
+	if transport != nil {
+		preloadHttp(L, transport)
+	}
 	if err := L.DoFile(pluginPath); err != nil{
 		return nil,err
 	}
@@ -169,6 +235,18 @@ func runGolangPlugin(pluginPath,addr string,ctx context.Context)(map[string]inte
 	}
 }
 
+func resolveUrl(base, ref string) string {
+	baseUrl, err := url.Parse(base)
+	if err != nil {
+		return ref
+	}
+	refUrl, err := url.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	return baseUrl.ResolveReference(refUrl).String()
+}
+
 func MD5Hash(text string) string {
 	hash := md5.Sum([]byte(text))
 	return hex.EncodeToString(hash[:])
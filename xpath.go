@@ -0,0 +1,158 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/antchfx/xpath"
+	"golang.org/x/net/html"
+)
+
+// htmlNavigator walks a html node tree for xpath, the node it is created with
+// is the root of the expressions.
+type htmlNavigator struct {
+	root, curr *html.Node
+	// attr is the index of the current attribute of curr, -1 when the
+	// navigator is on the node itself
+	attr int
+}
+
+func newHtmlNavigator(n *html.Node) *htmlNavigator {
+	return &htmlNavigator{root: n, curr: n, attr: -1}
+}
+
+func (h *htmlNavigator) Current() *html.Node {
+	return h.curr
+}
+
+func (h *htmlNavigator) NodeType() xpath.NodeType {
+	switch h.curr.Type {
+	case html.CommentNode:
+		return xpath.CommentNode
+	case html.TextNode:
+		return xpath.TextNode
+	case html.ElementNode:
+		if h.attr != -1 {
+			return xpath.AttributeNode
+		}
+		return xpath.ElementNode
+	default:
+		return xpath.RootNode
+	}
+}
+
+func (h *htmlNavigator) LocalName() string {
+	if h.attr != -1 {
+		return h.curr.Attr[h.attr].Key
+	}
+	return h.curr.Data
+}
+
+func (h *htmlNavigator) Prefix() string {
+	return ""
+}
+
+func (h *htmlNavigator) Value() string {
+	switch h.curr.Type {
+	case html.CommentNode, html.TextNode:
+		return h.curr.Data
+	case html.ElementNode:
+		if h.attr != -1 {
+			return h.curr.Attr[h.attr].Val
+		}
+		return htmlNodeText(h.curr)
+	}
+	return ""
+}
+
+func (h *htmlNavigator) Copy() xpath.NodeNavigator {
+	n := *h
+	return &n
+}
+
+func (h *htmlNavigator) MoveToRoot() {
+	h.curr, h.attr = h.root, -1
+}
+
+func (h *htmlNavigator) MoveToParent() bool {
+	if h.attr != -1 {
+		h.attr = -1
+		return true
+	}
+	if h.curr.Parent == nil {
+		return false
+	}
+	h.curr = h.curr.Parent
+	return true
+}
+
+func (h *htmlNavigator) MoveToNextAttribute() bool {
+	if h.attr >= len(h.curr.Attr)-1 {
+		return false
+	}
+	h.attr++
+	return true
+}
+
+func (h *htmlNavigator) MoveToChild() bool {
+	if h.attr != -1 || h.curr.FirstChild == nil {
+		return false
+	}
+	h.curr = h.curr.FirstChild
+	return true
+}
+
+func (h *htmlNavigator) MoveToFirst() bool {
+	if h.attr != -1 || h.curr.PrevSibling == nil {
+		return false
+	}
+	for h.curr.PrevSibling != nil {
+		h.curr = h.curr.PrevSibling
+	}
+	return true
+}
+
+func (h *htmlNavigator) MoveToNext() bool {
+	if h.attr != -1 || h.curr.NextSibling == nil {
+		return false
+	}
+	h.curr = h.curr.NextSibling
+	return true
+}
+
+func (h *htmlNavigator) MoveToPrevious() bool {
+	if h.attr != -1 || h.curr.PrevSibling == nil {
+		return false
+	}
+	h.curr = h.curr.PrevSibling
+	return true
+}
+
+func (h *htmlNavigator) MoveTo(other xpath.NodeNavigator) bool {
+	node, ok := other.(*htmlNavigator)
+	if !ok || node.root != h.root {
+		return false
+	}
+	h.curr, h.attr = node.curr, node.attr
+	return true
+}
+
+func (h *htmlNavigator) String() string {
+	return h.Value()
+}
+
+// htmlNodeText is the text of the text nodes under n.
+func htmlNodeText(n *html.Node) string {
+	var b strings.Builder
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			b.WriteString(n.Data)
+			return
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return b.String()
+}